@@ -18,6 +18,8 @@ package cmd
 
 import (
 	"github.com/spf13/viper"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/gethmetrics"
 )
 
 const (
@@ -39,16 +41,40 @@ const (
 	STATEDIFF_TRIE_WORKERS      = "STATEDIFF_TRIE_WORKERS"
 	STATEDIFF_SERVICE_WORKERS   = "STATEDIFF_SERVICE_WORKERS"
 	STATEDIFF_WORKER_QUEUE_SIZE = "STATEDIFF_WORKER_QUEUE_SIZE"
+	STATEDIFF_COMPLETION_LOG    = "STATEDIFF_COMPLETION_LOG"
+	STATEDIFF_PIPELINE_DEPTH    = "STATEDIFF_PIPELINE_DEPTH"
+	STATEDIFF_BATCH_SIZE        = "STATEDIFF_BATCH_SIZE"
+	STATEDIFF_PREFETCH_NODES    = "STATEDIFF_PREFETCH_NODES"
+	STATEDIFF_TIMING_HISTORY    = "STATEDIFF_TIMING_HISTORY"
+	STATEDIFF_SLOW_BLOCK        = "STATEDIFF_SLOW_BLOCK_THRESHOLD"
+	STATEDIFF_INTERACTIVE       = "STATEDIFF_INTERACTIVE_WORKERS"
 
 	SERVICE_IPC_PATH  = "SERVICE_IPC_PATH"
 	SERVICE_HTTP_PATH = "SERVICE_HTTP_PATH"
 
+	SERVICE_HTTP_READ_TIMEOUT  = "SERVICE_HTTP_READ_TIMEOUT"
+	SERVICE_HTTP_WRITE_TIMEOUT = "SERVICE_HTTP_WRITE_TIMEOUT"
+	SERVICE_HTTP_IDLE_TIMEOUT  = "SERVICE_HTTP_IDLE_TIMEOUT"
+	SERVICE_HTTP_CORS          = "SERVICE_HTTP_CORS"
+	SERVICE_HTTP_VHOSTS        = "SERVICE_HTTP_VHOSTS"
+	SERVICE_HTTP_MODULES       = "SERVICE_HTTP_MODULES"
+	SERVICE_HTTP_MAX_BODY_SIZE = "SERVICE_HTTP_MAX_BODY_SIZE"
+	SERVICE_HTTP_WS            = "SERVICE_HTTP_WS"
+
+	AUTH_JWT_SECRET = "AUTH_JWT_SECRET"
+	AUTH_TOKENS     = "AUTH_TOKENS"
+	AUTH_PROTECTED  = "AUTH_PROTECTED"
+
 	PROM_METRICS   = "PROM_METRICS"
 	PROM_HTTP      = "PROM_HTTP"
 	PROM_HTTP_ADDR = "PROM_HTTP_ADDR"
 	PROM_HTTP_PORT = "PROM_HTTP_PORT"
 	PROM_DB_STATS  = "PROM_DB_STATS"
 
+	PROM_PUSHGATEWAY   = "PROM_PUSHGATEWAY"
+	PROM_PUSH_INTERVAL = "PROM_PUSH_INTERVAL"
+	PROM_PUSH_JOB      = "PROM_PUSH_JOB"
+
 	PRERUN_ONLY             = "PRERUN_ONLY"
 	PRERUN_PARALLEL         = "PRERUN_PARALLEL"
 	PRERUN_RANGE_START      = "PRERUN_RANGE_START"
@@ -57,9 +83,35 @@ const (
 	PRERUN_INCLUDE_RECEIPTS = "PRERUN_INCLUDE_RECEIPTS"
 	PRERUN_INCLUDE_TD       = "PRERUN_INCLUDE_TD"
 	PRERUN_INCLUDE_CODE     = "PRERUN_INCLUDE_CODE"
+	PRERUN_SKIP_EXISTING    = "PRERUN_SKIP_EXISTING"
+	PRERUN_PRIORITY         = "PRERUN_PRIORITY"
+	PRERUN_REPORT_FILE      = "PRERUN_REPORT_FILE"
+
+	CAR_DIR       = "CAR_DIR"
+	CAR_VERSION   = "CAR_VERSION"
+	CAR_OVERWRITE = "CAR_OVERWRITE"
+
+	THROTTLE_TARGET_LATENCY = "THROTTLE_TARGET_LATENCY"
+	THROTTLE_INTERVAL       = "THROTTLE_INTERVAL"
+	THROTTLE_MAX_DELAY      = "THROTTLE_MAX_DELAY"
+
+	MEMORY_BUDGET          = "MEMORY_BUDGET"
+	MEMORY_CGROUP_FRACTION = "MEMORY_CGROUP_FRACTION"
+	MEMORY_OVERHEAD        = "MEMORY_OVERHEAD"
+
+	LOG_LEVEL  = "LOG_LEVEL"
+	LOG_FILE   = "LOG_FILE"
+	LOG_FORMAT = "LOG_FORMAT"
 
-	LOG_LEVEL = "LOG_LEVEL"
-	LOG_FILE  = "LOG_FILE"
+	HEALTH_STUCK_DEADLINE = "HEALTH_STUCK_DEADLINE"
+	HEALTH_CHECK_TIMEOUT  = "HEALTH_CHECK_TIMEOUT"
+
+	TRACING_EXPORTER     = "TRACING_EXPORTER"
+	TRACING_ENDPOINT     = "TRACING_ENDPOINT"
+	TRACING_INSECURE     = "TRACING_INSECURE"
+	TRACING_FILE         = "TRACING_FILE"
+	TRACING_SAMPLE_RATIO = "TRACING_SAMPLE_RATIO"
+	TRACING_SERVICE_NAME = "TRACING_SERVICE_NAME"
 
 	DATABASE_NAME     = "DATABASE_NAME"
 	DATABASE_HOSTNAME = "DATABASE_HOSTNAME"
@@ -70,6 +122,8 @@ const (
 	DATABASE_TYPE         = "DATABASE_TYPE"
 	DATABASE_DRIVER_TYPE  = "DATABASE_DRIVER_TYPE"
 	DATABASE_DUMP_DST     = "DATABASE_DUMP_DST"
+	DATABASE_DUMP_FILE    = "DATABASE_DUMP_FILE"
+	DATABASE_DUMP_FORMAT  = "DATABASE_DUMP_FORMAT"
 	DATABASE_FILE_PATH    = "DATABASE_FILE_PATH"
 	DATABASE_FILE_MODE    = "DATABASE_FILE_MODE"
 	DATABASE_FILE_CSV_DIR = "DATABASE_FILE_CSV_DIR"
@@ -88,6 +142,18 @@ const (
 func init() {
 	viper.BindEnv("server.ipcPath", SERVICE_IPC_PATH)
 	viper.BindEnv("server.httpPath", SERVICE_HTTP_PATH)
+	viper.BindEnv("server.httpReadTimeout", SERVICE_HTTP_READ_TIMEOUT)
+	viper.BindEnv("server.httpWriteTimeout", SERVICE_HTTP_WRITE_TIMEOUT)
+	viper.BindEnv("server.httpIdleTimeout", SERVICE_HTTP_IDLE_TIMEOUT)
+	viper.BindEnv("server.httpCors", SERVICE_HTTP_CORS)
+	viper.BindEnv("server.httpVhosts", SERVICE_HTTP_VHOSTS)
+	viper.BindEnv("server.httpModules", SERVICE_HTTP_MODULES)
+	viper.BindEnv("server.httpMaxBodySize", SERVICE_HTTP_MAX_BODY_SIZE)
+	viper.BindEnv("server.httpWS", SERVICE_HTTP_WS)
+
+	viper.BindEnv("auth.jwtSecret", AUTH_JWT_SECRET)
+	viper.BindEnv("auth.tokens", AUTH_TOKENS)
+	viper.BindEnv("auth.protected", AUTH_PROTECTED)
 
 	viper.BindEnv("ethereum.nodeID", ETH_NODE_ID)
 	viper.BindEnv("ethereum.clientName", ETH_CLIENT_NAME)
@@ -112,6 +178,8 @@ func init() {
 	viper.BindEnv("database.type", DATABASE_TYPE)
 	viper.BindEnv("database.driver", DATABASE_DRIVER_TYPE)
 	viper.BindEnv("database.dumpDestination", DATABASE_DUMP_DST)
+	viper.BindEnv("database.dumpFile", DATABASE_DUMP_FILE)
+	viper.BindEnv("database.dumpFormat", DATABASE_DUMP_FORMAT)
 	viper.BindEnv("database.fileMode", DATABASE_FILE_MODE)
 	viper.BindEnv("database.filePath", DATABASE_FILE_PATH)
 	viper.BindEnv("database.fileCsvDir", DATABASE_FILE_CSV_DIR)
@@ -125,14 +193,25 @@ func init() {
 	viper.BindEnv("leveldb.url", LEVELDB_URL)
 
 	viper.BindEnv("prom.metrics", PROM_METRICS)
+	viper.BindEnv(gethmetrics.Key, gethmetrics.EnvVar)
 	viper.BindEnv("prom.http", PROM_HTTP)
 	viper.BindEnv("prom.httpAddr", PROM_HTTP_ADDR)
 	viper.BindEnv("prom.httpPort", PROM_HTTP_PORT)
 	viper.BindEnv("prom.dbStats", PROM_DB_STATS)
+	viper.BindEnv("prom.pushgateway", PROM_PUSHGATEWAY)
+	viper.BindEnv("prom.pushInterval", PROM_PUSH_INTERVAL)
+	viper.BindEnv("prom.pushJob", PROM_PUSH_JOB)
 
 	viper.BindEnv("statediff.serviceWorkers", STATEDIFF_SERVICE_WORKERS)
 	viper.BindEnv("statediff.trieWorkers", STATEDIFF_TRIE_WORKERS)
 	viper.BindEnv("statediff.workerQueueSize", STATEDIFF_WORKER_QUEUE_SIZE)
+	viper.BindEnv("statediff.completionLog", STATEDIFF_COMPLETION_LOG)
+	viper.BindEnv("statediff.pipelineDepth", STATEDIFF_PIPELINE_DEPTH)
+	viper.BindEnv("statediff.batchSize", STATEDIFF_BATCH_SIZE)
+	viper.BindEnv("statediff.prefetchNodes", STATEDIFF_PREFETCH_NODES)
+	viper.BindEnv("statediff.timingHistory", STATEDIFF_TIMING_HISTORY)
+	viper.BindEnv("statediff.slowBlockThreshold", STATEDIFF_SLOW_BLOCK)
+	viper.BindEnv("statediff.interactiveWorkers", STATEDIFF_INTERACTIVE)
 
 	viper.BindEnv("statediff.prerun", STATEDIFF_PRERUN)
 	viper.BindEnv("prerun.only", PRERUN_ONLY)
@@ -143,9 +222,35 @@ func init() {
 	viper.BindEnv("prerun.params.includeReceipts", PRERUN_INCLUDE_RECEIPTS)
 	viper.BindEnv("prerun.params.includeTD", PRERUN_INCLUDE_TD)
 	viper.BindEnv("prerun.params.includeCode", PRERUN_INCLUDE_CODE)
+	viper.BindEnv("prerun.skipExisting", PRERUN_SKIP_EXISTING)
+	viper.BindEnv("prerun.priority", PRERUN_PRIORITY)
+	viper.BindEnv("prerun.reportFile", PRERUN_REPORT_FILE)
+
+	viper.BindEnv("car.dir", CAR_DIR)
+	viper.BindEnv("car.version", CAR_VERSION)
+	viper.BindEnv("car.overwrite", CAR_OVERWRITE)
+
+	viper.BindEnv("throttle.targetLatency", THROTTLE_TARGET_LATENCY)
+	viper.BindEnv("throttle.interval", THROTTLE_INTERVAL)
+	viper.BindEnv("throttle.maxDelay", THROTTLE_MAX_DELAY)
+
+	viper.BindEnv("memory.budget", MEMORY_BUDGET)
+	viper.BindEnv("memory.cgroupFraction", MEMORY_CGROUP_FRACTION)
+	viper.BindEnv("memory.overhead", MEMORY_OVERHEAD)
 
 	viper.BindEnv("log.level", LOG_LEVEL)
 	viper.BindEnv("log.file", LOG_FILE)
+	viper.BindEnv("log.format", LOG_FORMAT)
+
+	viper.BindEnv("health.stuckDeadline", HEALTH_STUCK_DEADLINE)
+	viper.BindEnv("health.checkTimeout", HEALTH_CHECK_TIMEOUT)
+
+	viper.BindEnv("tracing.exporter", TRACING_EXPORTER)
+	viper.BindEnv("tracing.endpoint", TRACING_ENDPOINT)
+	viper.BindEnv("tracing.insecure", TRACING_INSECURE)
+	viper.BindEnv("tracing.file", TRACING_FILE)
+	viper.BindEnv("tracing.sampleRatio", TRACING_SAMPLE_RATIO)
+	viper.BindEnv("tracing.serviceName", TRACING_SERVICE_NAME)
 
 	viper.BindEnv("debug.pprof", DEBUG_PPROF)
 }
@@ -17,7 +17,9 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"strings"
@@ -30,17 +32,27 @@ import (
 	"github.com/cerc-io/plugeth-statediff/indexer/node"
 	"github.com/cerc-io/plugeth-statediff/indexer/shared"
 	"github.com/ethereum/go-ethereum/cmd/utils"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rpc"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/cerc-io/eth-statediff-service/pkg/gethmetrics"
+	"github.com/cerc-io/eth-statediff-service/pkg/jsonl"
 	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	srpc "github.com/cerc-io/eth-statediff-service/pkg/rpc"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
 )
 
 var (
 	cfgFile        string
 	subCommand     string
 	logWithCommand log.Entry
+	// flushes and stops the trace exporter
+	shutdownTracing = func(context.Context) error { return nil }
+	// stops the periodic pushes and pushes the final metrics
+	stopPush = func() error { return nil }
 )
 
 var rootCmd = &cobra.Command{
@@ -69,13 +81,40 @@ func initFuncs(cmd *cobra.Command, args []string) {
 	} else {
 		log.SetOutput(os.Stdout)
 	}
+	if err := logFormat(); err != nil {
+		log.Fatal("Could not set log format: ", err)
+	}
 	if err := logLevel(); err != nil {
 		log.Fatal("Could not set log level: ", err)
 	}
 
+	if exporter := viper.GetString("tracing.exporter"); exporter != "" {
+		log.Infof("initializing tracing with the %s exporter", exporter)
+		shutdown, err := tracing.Init(tracing.Config{
+			Exporter:    exporter,
+			Endpoint:    viper.GetString("tracing.endpoint"),
+			Insecure:    viper.GetBool("tracing.insecure"),
+			File:        viper.GetString("tracing.file"),
+			SampleRatio: viper.GetFloat64("tracing.sampleRatio"),
+			ServiceName: viper.GetString("tracing.serviceName"),
+		})
+		if err != nil {
+			log.Fatal("Could not initialize tracing: ", err)
+		}
+		shutdownTracing = shutdown
+	}
+
 	if viper.GetBool("prom.metrics") {
 		log.Info("initializing prometheus metrics")
 		prom.Init()
+		if !metrics.Enabled {
+			log.Infof("go-ethereum metrics are disabled, the trie cache metrics are only exported with %s", gethmetrics.Key)
+		}
+
+		if url := viper.GetString("prom.pushgateway"); url != "" {
+			log.Infof("pushing metrics to %s", url)
+			stopPush = prom.StartPush(url, viper.GetString("prom.pushJob"), viper.GetDuration("prom.pushInterval"))
+		}
 	}
 
 	if viper.GetBool("prom.http") {
@@ -89,6 +128,34 @@ func initFuncs(cmd *cobra.Command, args []string) {
 	}
 }
 
+// flushTraces exports the spans still buffered and stops the trace exporter
+func flushTraces() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Errorf("error flushing traces: %v", err)
+	}
+}
+
+// pushMetrics pushes the final metrics to the pushgateway, if configured
+func pushMetrics() {
+	if err := stopPush(); err != nil {
+		log.Errorf("error pushing metrics: %v", err)
+	}
+}
+
+func logFormat() error {
+	switch format := viper.GetString("log.format"); format {
+	case "", "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	return nil
+}
+
 func logLevel() error {
 	lvl, err := log.ParseLevel(viper.GetString("log.level"))
 	if err != nil {
@@ -109,11 +176,23 @@ func init() {
 
 	rootCmd.PersistentFlags().String("http-path", "", "vdb server http path")
 	rootCmd.PersistentFlags().String("ipc-path", "", "vdb server ipc path")
+	rootCmd.PersistentFlags().Duration("http-read-timeout", rpc.DefaultHTTPTimeouts.ReadTimeout, "maximum duration for reading an HTTP request")
+	rootCmd.PersistentFlags().Duration("http-write-timeout", rpc.DefaultHTTPTimeouts.WriteTimeout, "maximum duration of an HTTP request, including writing the response")
+	rootCmd.PersistentFlags().Duration("http-idle-timeout", rpc.DefaultHTTPTimeouts.IdleTimeout, "maximum time to wait for the next request on an HTTP keep-alive connection")
+	rootCmd.PersistentFlags().StringSlice("http-cors", nil, "comma separated list of origins allowed to make cross-origin HTTP requests")
+	rootCmd.PersistentFlags().StringSlice("http-vhosts", []string{"*"}, "comma separated list of virtual hostnames accepted by the HTTP server")
+	rootCmd.PersistentFlags().StringSlice("http-modules", []string{"statediff"}, "comma separated list of API namespaces served over HTTP")
+	rootCmd.PersistentFlags().Int64("http-max-body-size", srpc.MaxRequestContentLength, "maximum size of an HTTP request body in bytes")
+	rootCmd.PersistentFlags().Bool("http-ws", false, "serve websocket connections on the HTTP endpoint")
+	rootCmd.PersistentFlags().String("auth-jwt-secret", "", "file containing the hex encoded 32 byte secret of JWTs accepted by the HTTP endpoint")
+	rootCmd.PersistentFlags().StringSlice("auth-tokens", nil, "comma separated list of static bearer tokens accepted by the HTTP endpoint")
+	rootCmd.PersistentFlags().StringSlice("auth-protected", nil, "comma separated list of namespaces and methods which require a token (all if empty)")
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file location")
 
 	rootCmd.PersistentFlags().String("log-file", "", "file path for logging")
 	rootCmd.PersistentFlags().String("log-level", log.InfoLevel.String(),
 		"log level (trace, debug, info, warn, error, fatal, panic")
+	rootCmd.PersistentFlags().String("log-format", "text", "log format (text, json)")
 
 	rootCmd.PersistentFlags().String("leveldb-mode", "local", "LevelDB access mode (local, remote)")
 	rootCmd.PersistentFlags().String("leveldb-path", "", "path to primary datastore")
@@ -124,6 +203,13 @@ func init() {
 	rootCmd.PersistentFlags().Int("service-workers", 1, "number of range requests to process concurrently")
 	rootCmd.PersistentFlags().Int("trie-workers", 1, "number of workers to use for trie traversal and processing")
 	rootCmd.PersistentFlags().Int("worker-queue-size", 1024, "size of the range request queue for service workers")
+	rootCmd.PersistentFlags().String("completion-log", "", "directory of the database recording fully written blocks, for outputs other than Postgres; required to skip existing blocks")
+	rootCmd.PersistentFlags().Uint("interactive-workers", 1, "number of additional workers reserved for interactive requests")
+	rootCmd.PersistentFlags().Uint64("batch-size", 64, "number of blocks of a range handed out to a worker at a time")
+	rootCmd.PersistentFlags().Uint("timing-history", 1024, "number of most recently written blocks to keep timings for (0 to disable)")
+	rootCmd.PersistentFlags().Duration("slow-block-threshold", 0, "log the timing breakdown of blocks taking at least this long (0 to disable)")
+	rootCmd.PersistentFlags().Uint("prefetch-nodes", 0, "maximum number of trie nodes to prefetch per upcoming block (0 to disable)")
+	rootCmd.PersistentFlags().Uint("pipeline-depth", 2, "number of blocks queued between the load, diff and commit stages")
 
 	rootCmd.PersistentFlags().String("database-name", "cerc_public", "database name")
 	rootCmd.PersistentFlags().Int("database-port", 5432, "database port")
@@ -138,11 +224,25 @@ func init() {
 	rootCmd.PersistentFlags().Duration("database-max-idle-time", 0, "database max connection idle time")
 	rootCmd.PersistentFlags().String("database-type", "postgres", "database type (currently supported: postgres, dump)")
 	rootCmd.PersistentFlags().String("database-driver", "sqlx", "database driver type (currently supported: sqlx, pgx)")
-	rootCmd.PersistentFlags().String("database-dump-dst", "stdout", "dump destination (for database-type=dump; options: stdout, stderr, discard)")
+	rootCmd.PersistentFlags().String("database-dump-dst", "stdout", "dump destination (for database-type=dump; options: stdout, stderr, discard, file)")
+	rootCmd.PersistentFlags().String("database-dump-file", "", "full file path (for database-dump-dst=file)")
+	rootCmd.PersistentFlags().String("database-dump-format", "debug", "dump output format (for database-type=dump; options: debug, json)")
 	rootCmd.PersistentFlags().String("database-file-mode", "csv", "mode for writing file (for database-type=file; options: csv, sql)")
 	rootCmd.PersistentFlags().String("database-file-csv-dir", "", "full directory path (for database-file-mode=csv)")
 	rootCmd.PersistentFlags().String("database-file-path", "", "full file path (for database-file-mode=sql)")
 
+	rootCmd.PersistentFlags().String("car-dir", "", "directory to write a CAR file per processed block range into (disabled if empty)")
+	rootCmd.PersistentFlags().Int("car-version", 1, "CAR format version (1 or 2)")
+	rootCmd.PersistentFlags().Bool("car-overwrite", false, "replace existing CAR files instead of writing under a suffixed name")
+
+	rootCmd.PersistentFlags().Duration("throttle-target-latency", 0, "commit latency to keep database writes under (0 disables throttling)")
+	rootCmd.PersistentFlags().Duration("throttle-interval", 10*time.Second, "how often the throttle evaluates commit latency")
+	rootCmd.PersistentFlags().Duration("throttle-max-delay", 5*time.Second, "maximum delay inserted by the throttle before writing a block")
+
+	rootCmd.PersistentFlags().Uint64("memory-budget", 0, "memory budget in bytes for the blocks in processing (0 to disable)")
+	rootCmd.PersistentFlags().Float64("memory-cgroup-fraction", 0, "derive the memory budget as this fraction of the cgroup memory limit, if no budget is set")
+	rootCmd.PersistentFlags().Float64("memory-overhead", 4, "multiplier from the bytes written for a block to its estimated peak memory")
+
 	rootCmd.PersistentFlags().String("eth-node-id", "", "eth node id")
 	rootCmd.PersistentFlags().String("eth-client-name", "eth-statediff-service", "eth client name")
 	rootCmd.PersistentFlags().String("eth-genesis-block",
@@ -158,6 +258,21 @@ func init() {
 	rootCmd.PersistentFlags().String("prom-http-port", "8080", "prometheus http port")
 	rootCmd.PersistentFlags().Bool("prom-db-stats", false, "enables prometheus db stats")
 	rootCmd.PersistentFlags().Bool("prom-metrics", false, "enable prometheus metrics")
+	// read on start up by the gethmetrics package, before any flags are parsed
+	rootCmd.PersistentFlags().Bool(gethmetrics.Flag, false, "enable go-ethereum's metrics, which the trie cache metrics are read from")
+	rootCmd.PersistentFlags().String("prom-pushgateway", "", "prometheus pushgateway URL to push the metrics to on exit")
+	rootCmd.PersistentFlags().Duration("prom-push-interval", 0, "interval of metrics pushes to the pushgateway during the run (0 to only push on exit)")
+	rootCmd.PersistentFlags().String("prom-push-job", "eth-statediff-service", "job name of the metrics pushed to the pushgateway")
+
+	rootCmd.PersistentFlags().Duration("health-stuck-deadline", 0, "report the service as not live when a worker spends longer than this on a block (0 to disable)")
+	rootCmd.PersistentFlags().Duration("health-check-timeout", 5*time.Second, "timeout of each readiness check")
+
+	rootCmd.PersistentFlags().String("tracing-exporter", "", "trace exporter (otlp, file); tracing is disabled if empty")
+	rootCmd.PersistentFlags().String("tracing-endpoint", "localhost:4318", "OTLP/HTTP collector endpoint")
+	rootCmd.PersistentFlags().Bool("tracing-insecure", false, "connect to the OTLP collector without TLS")
+	rootCmd.PersistentFlags().String("tracing-file", "traces.json", "file to write spans to with the file exporter")
+	rootCmd.PersistentFlags().Float64("tracing-sample-ratio", 1, "fraction of traces to sample")
+	rootCmd.PersistentFlags().String("tracing-service-name", "eth-statediff-service", "service name reported in traces")
 
 	rootCmd.PersistentFlags().Bool("prerun-only", false, "only process pre-configured ranges; exit afterwards")
 	rootCmd.PersistentFlags().Int("prerun-start", 0, "start height for a prerun range")
@@ -166,17 +281,39 @@ func init() {
 	rootCmd.PersistentFlags().Bool("prerun-include-receipts", true, "include receipts in the statediff payload")
 	rootCmd.PersistentFlags().Bool("prerun-include-td", true, "include td in the statediff payload")
 	rootCmd.PersistentFlags().Bool("prerun-include-code", true, "include code and codehash mappings in statediff payload")
+	rootCmd.PersistentFlags().Bool("prerun-skip-existing", false, "skip blocks which were already written")
+	rootCmd.PersistentFlags().String("prerun-priority", "bulk", "priority class of the prerun ranges (interactive, normal or bulk)")
+	rootCmd.PersistentFlags().String("prerun-report-file", "", "file to write a JSON summary of a prerun-only run to")
 
 	viper.BindPFlag("server.httpPath", rootCmd.PersistentFlags().Lookup("http-path"))
 	viper.BindPFlag("server.ipcPath", rootCmd.PersistentFlags().Lookup("ipc-path"))
+	viper.BindPFlag("server.httpReadTimeout", rootCmd.PersistentFlags().Lookup("http-read-timeout"))
+	viper.BindPFlag("server.httpWriteTimeout", rootCmd.PersistentFlags().Lookup("http-write-timeout"))
+	viper.BindPFlag("server.httpIdleTimeout", rootCmd.PersistentFlags().Lookup("http-idle-timeout"))
+	viper.BindPFlag("server.httpCors", rootCmd.PersistentFlags().Lookup("http-cors"))
+	viper.BindPFlag("server.httpVhosts", rootCmd.PersistentFlags().Lookup("http-vhosts"))
+	viper.BindPFlag("server.httpModules", rootCmd.PersistentFlags().Lookup("http-modules"))
+	viper.BindPFlag("server.httpMaxBodySize", rootCmd.PersistentFlags().Lookup("http-max-body-size"))
+	viper.BindPFlag("server.httpWS", rootCmd.PersistentFlags().Lookup("http-ws"))
+	viper.BindPFlag("auth.jwtSecret", rootCmd.PersistentFlags().Lookup("auth-jwt-secret"))
+	viper.BindPFlag("auth.tokens", rootCmd.PersistentFlags().Lookup("auth-tokens"))
+	viper.BindPFlag("auth.protected", rootCmd.PersistentFlags().Lookup("auth-protected"))
 
 	viper.BindPFlag("log.file", rootCmd.PersistentFlags().Lookup("log-file"))
 	viper.BindPFlag("log.level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("log.format", rootCmd.PersistentFlags().Lookup("log-format"))
 
 	viper.BindPFlag("statediff.prerun", rootCmd.PersistentFlags().Lookup("prerun"))
 	viper.BindPFlag("statediff.serviceWorkers", rootCmd.PersistentFlags().Lookup("service-workers"))
 	viper.BindPFlag("statediff.trieWorkers", rootCmd.PersistentFlags().Lookup("trie-workers"))
 	viper.BindPFlag("statediff.workerQueueSize", rootCmd.PersistentFlags().Lookup("worker-queue-size"))
+	viper.BindPFlag("statediff.completionLog", rootCmd.PersistentFlags().Lookup("completion-log"))
+	viper.BindPFlag("statediff.interactiveWorkers", rootCmd.PersistentFlags().Lookup("interactive-workers"))
+	viper.BindPFlag("statediff.batchSize", rootCmd.PersistentFlags().Lookup("batch-size"))
+	viper.BindPFlag("statediff.timingHistory", rootCmd.PersistentFlags().Lookup("timing-history"))
+	viper.BindPFlag("statediff.slowBlockThreshold", rootCmd.PersistentFlags().Lookup("slow-block-threshold"))
+	viper.BindPFlag("statediff.prefetchNodes", rootCmd.PersistentFlags().Lookup("prefetch-nodes"))
+	viper.BindPFlag("statediff.pipelineDepth", rootCmd.PersistentFlags().Lookup("pipeline-depth"))
 
 	viper.BindPFlag("leveldb.mode", rootCmd.PersistentFlags().Lookup("leveldb-mode"))
 	viper.BindPFlag("leveldb.path", rootCmd.PersistentFlags().Lookup("leveldb-path"))
@@ -197,10 +334,24 @@ func init() {
 	viper.BindPFlag("database.type", rootCmd.PersistentFlags().Lookup("database-type"))
 	viper.BindPFlag("database.driver", rootCmd.PersistentFlags().Lookup("database-driver"))
 	viper.BindPFlag("database.dumpDestination", rootCmd.PersistentFlags().Lookup("database-dump-dst"))
+	viper.BindPFlag("database.dumpFile", rootCmd.PersistentFlags().Lookup("database-dump-file"))
+	viper.BindPFlag("database.dumpFormat", rootCmd.PersistentFlags().Lookup("database-dump-format"))
 	viper.BindPFlag("database.fileMode", rootCmd.PersistentFlags().Lookup("database-file-mode"))
 	viper.BindPFlag("database.fileCsvDir", rootCmd.PersistentFlags().Lookup("database-file-csv-dir"))
 	viper.BindPFlag("database.filePath", rootCmd.PersistentFlags().Lookup("database-file-path"))
 
+	viper.BindPFlag("car.dir", rootCmd.PersistentFlags().Lookup("car-dir"))
+	viper.BindPFlag("car.version", rootCmd.PersistentFlags().Lookup("car-version"))
+	viper.BindPFlag("car.overwrite", rootCmd.PersistentFlags().Lookup("car-overwrite"))
+
+	viper.BindPFlag("throttle.targetLatency", rootCmd.PersistentFlags().Lookup("throttle-target-latency"))
+	viper.BindPFlag("throttle.interval", rootCmd.PersistentFlags().Lookup("throttle-interval"))
+	viper.BindPFlag("throttle.maxDelay", rootCmd.PersistentFlags().Lookup("throttle-max-delay"))
+
+	viper.BindPFlag("memory.budget", rootCmd.PersistentFlags().Lookup("memory-budget"))
+	viper.BindPFlag("memory.cgroupFraction", rootCmd.PersistentFlags().Lookup("memory-cgroup-fraction"))
+	viper.BindPFlag("memory.overhead", rootCmd.PersistentFlags().Lookup("memory-overhead"))
+
 	viper.BindPFlag("ethereum.nodeID", rootCmd.PersistentFlags().Lookup("eth-node-id"))
 	viper.BindPFlag("ethereum.clientName", rootCmd.PersistentFlags().Lookup("eth-client-name"))
 	viper.BindPFlag("ethereum.genesisBlock", rootCmd.PersistentFlags().Lookup("eth-genesis-block"))
@@ -216,6 +367,20 @@ func init() {
 	viper.BindPFlag("prom.httpPort", rootCmd.PersistentFlags().Lookup("prom-http-port"))
 	viper.BindPFlag("prom.dbStats", rootCmd.PersistentFlags().Lookup("prom-db-stats"))
 	viper.BindPFlag("prom.metrics", rootCmd.PersistentFlags().Lookup("prom-metrics"))
+	viper.BindPFlag(gethmetrics.Key, rootCmd.PersistentFlags().Lookup(gethmetrics.Flag))
+	viper.BindPFlag("prom.pushgateway", rootCmd.PersistentFlags().Lookup("prom-pushgateway"))
+	viper.BindPFlag("prom.pushInterval", rootCmd.PersistentFlags().Lookup("prom-push-interval"))
+	viper.BindPFlag("prom.pushJob", rootCmd.PersistentFlags().Lookup("prom-push-job"))
+
+	viper.BindPFlag("health.stuckDeadline", rootCmd.PersistentFlags().Lookup("health-stuck-deadline"))
+	viper.BindPFlag("health.checkTimeout", rootCmd.PersistentFlags().Lookup("health-check-timeout"))
+
+	viper.BindPFlag("tracing.exporter", rootCmd.PersistentFlags().Lookup("tracing-exporter"))
+	viper.BindPFlag("tracing.endpoint", rootCmd.PersistentFlags().Lookup("tracing-endpoint"))
+	viper.BindPFlag("tracing.insecure", rootCmd.PersistentFlags().Lookup("tracing-insecure"))
+	viper.BindPFlag("tracing.file", rootCmd.PersistentFlags().Lookup("tracing-file"))
+	viper.BindPFlag("tracing.sampleRatio", rootCmd.PersistentFlags().Lookup("tracing-sample-ratio"))
+	viper.BindPFlag("tracing.serviceName", rootCmd.PersistentFlags().Lookup("tracing-service-name"))
 
 	viper.BindPFlag("prerun.only", rootCmd.PersistentFlags().Lookup("prerun-only"))
 	viper.BindPFlag("prerun.parallel", rootCmd.PersistentFlags().Lookup("prerun-parallel"))
@@ -225,6 +390,8 @@ func init() {
 	viper.BindPFlag("prerun.params.includeReceipts", rootCmd.PersistentFlags().Lookup("prerun-include-receipts"))
 	viper.BindPFlag("prerun.params.includeTD", rootCmd.PersistentFlags().Lookup("prerun-include-td"))
 	viper.BindPFlag("prerun.params.includeCode", rootCmd.PersistentFlags().Lookup("prerun-include-code"))
+	viper.BindPFlag("prerun.skipExisting", rootCmd.PersistentFlags().Lookup("prerun-skip-existing"))
+	viper.BindPFlag("prerun.priority", rootCmd.PersistentFlags().Lookup("prerun-priority"))
 
 	viper.BindPFlag("debug.pprof", rootCmd.PersistentFlags().Lookup("debug-pprof"))
 
@@ -328,20 +495,30 @@ func getConfig(nodeInfo node.Info) (interfaces.Config, error) {
 		}
 	case shared.DUMP:
 		logWithCommand.Info("Starting in data dump mode")
-		dumpDstStr := viper.GetString("database.dumpDestination")
-		dumpDst, err := dump.ResolveDumpType(dumpDstStr)
-		if err != nil {
-			return nil, err
-		}
-		switch dumpDst {
-		case dump.STDERR:
-			indexerConfig = dump.Config{Dump: os.Stdout}
-		case dump.STDOUT:
-			indexerConfig = dump.Config{Dump: os.Stderr}
-		case dump.DISCARD:
-			indexerConfig = dump.Config{Dump: dump.Discard}
+		switch dumpFormat := strings.ToLower(viper.GetString("database.dumpFormat")); dumpFormat {
+		case "", "debug":
+			dumpDst, err := getDumpDestination()
+			if err != nil {
+				return nil, err
+			}
+			indexerConfig = dump.Config{Dump: dumpDst}
+		case "json":
+			// the JSON Lines indexer opens the dump file itself, and only closes the file it opened
+			if strings.ToLower(viper.GetString("database.dumpDestination")) == "file" {
+				dumpFile, err := getDumpFile()
+				if err != nil {
+					return nil, err
+				}
+				indexerConfig = jsonl.Config{Path: dumpFile}
+				break
+			}
+			dumpDst, err := getDumpDestination()
+			if err != nil {
+				return nil, err
+			}
+			indexerConfig = jsonl.Config{Dump: dumpDst}
 		default:
-			return nil, fmt.Errorf("unrecognized dump destination: %s", dumpDst)
+			return nil, fmt.Errorf("unrecognized dump format: %s", dumpFormat)
 		}
 	case shared.POSTGRES:
 		logWithCommand.Info("Starting in postgres mode")
@@ -382,3 +559,45 @@ func getConfig(nodeInfo node.Info) (interfaces.Config, error) {
 	}
 	return indexerConfig, nil
 }
+
+// getDumpDestination opens the configured destination for database-type=dump
+func getDumpDestination() (io.WriteCloser, error) {
+	dumpDstStr := viper.GetString("database.dumpDestination")
+	if strings.ToLower(dumpDstStr) == "file" {
+		dumpFile, err := getDumpFile()
+		if err != nil {
+			return nil, err
+		}
+		return os.OpenFile(dumpFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	}
+	dumpDst, err := dump.ResolveDumpType(dumpDstStr)
+	if err != nil {
+		return nil, err
+	}
+	switch dumpDst {
+	case dump.STDOUT:
+		return stdStream{os.Stdout}, nil
+	case dump.STDERR:
+		return stdStream{os.Stderr}, nil
+	case dump.DISCARD:
+		return dump.Discard, nil
+	default:
+		return nil, fmt.Errorf("unrecognized dump destination: %s", dumpDst)
+	}
+}
+
+// stdStream is a standard stream used as dump destination, which is left open when the indexer is closed
+type stdStream struct {
+	io.Writer
+}
+
+func (stdStream) Close() error { return nil }
+
+// getDumpFile returns the configured path for database-dump-dst=file
+func getDumpFile() (string, error) {
+	dumpFile := viper.GetString("database.dumpFile")
+	if dumpFile == "" {
+		return "", fmt.Errorf("when dumping to a file a file path must be provided")
+	}
+	return dumpFile, nil
+}
@@ -16,11 +16,14 @@
 package cmd
 
 import (
+	"context"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"sync"
 
 	"github.com/ethereum/go-ethereum/rpc"
@@ -85,7 +88,21 @@ func serve() {
 	// short circuit if we only want to perform prerun
 	if viper.GetBool("prerun.only") {
 		parallel := viper.GetBool("prerun.parallel")
-		if err := service.Run(nil, parallel); err != nil {
+		shutdown := make(chan os.Signal, 1)
+		signal.Notify(shutdown, os.Interrupt)
+		go func() {
+			<-shutdown
+			logWithCommand.Info("Received interrupt signal, finishing blocks in progress")
+			service.Stop()
+		}()
+		report, err := service.Run(nil, parallel)
+		closeService(service)
+		flushTraces()
+		pushMetrics()
+		if report != nil {
+			writeRunReport(report)
+		}
+		if err != nil {
 			logWithCommand.Fatalf("Unable to perform prerun: %v", err)
 		}
 		return
@@ -100,15 +117,26 @@ func serve() {
 	if err := startServers(service); err != nil {
 		logWithCommand.Fatal(err)
 	}
+	service.AddReadinessCheck(pkg.HealthCheck{Name: "rpc", Check: checkServers})
 	logWithCommand.Debug("RPC servers successfully spun up; awaiting requests")
 
 	// clean shutdown
-	shutdown := make(chan os.Signal)
+	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt)
 	<-shutdown
 	logWithCommand.Info("Received interrupt signal, shutting down")
 	service.Stop()
 	wg.Wait()
+	closeService(service)
+	flushTraces()
+	pushMetrics()
+}
+
+// closeService releases the resources of the service once it has stopped
+func closeService(service *pkg.Service) {
+	if err := service.Close(); err != nil {
+		logWithCommand.Errorf("Error closing statediff service: %v", err)
+	}
 }
 
 func startServers(serv *pkg.Service) error {
@@ -124,7 +152,11 @@ func startServers(serv *pkg.Service) error {
 		}
 	}
 	if httpPath != "" {
-		_, err := srpc.StartHTTPEndpoint(httpPath, serv.APIs(), []string{"statediff"}, nil, []string{"*"}, rpc.HTTPTimeouts{})
+		conf, err := httpConfig(httpPath)
+		if err != nil {
+			return err
+		}
+		_, err = srpc.StartHTTPEndpoint(conf, serv.APIs())
 		if err != nil {
 			return err
 		}
@@ -134,3 +166,57 @@ func startServers(serv *pkg.Service) error {
 
 	return nil
 }
+
+// httpConfig returns the configuration of the HTTP RPC endpoint
+func httpConfig(endpoint string) (srpc.HTTPConfig, error) {
+	auth := srpc.AuthConfig{
+		Tokens:    getStringList("auth.tokens"),
+		Protected: getStringList("auth.protected"),
+	}
+	if path := viper.GetString("auth.jwtSecret"); path != "" {
+		secret, err := readJWTSecret(path)
+		if err != nil {
+			return srpc.HTTPConfig{}, err
+		}
+		auth.JWTSecret = secret
+	}
+	readTimeout := viper.GetDuration("server.httpReadTimeout")
+	return srpc.HTTPConfig{
+		Endpoint: endpoint,
+		Modules:  getStringList("server.httpModules"),
+		Cors:     getStringList("server.httpCors"),
+		Vhosts:   getStringList("server.httpVhosts"),
+		Timeouts: rpc.HTTPTimeouts{
+			ReadTimeout:       readTimeout,
+			ReadHeaderTimeout: readTimeout,
+			WriteTimeout:      viper.GetDuration("server.httpWriteTimeout"),
+			IdleTimeout:       viper.GetDuration("server.httpIdleTimeout"),
+		},
+		MaxBodySize: viper.GetInt64("server.httpMaxBodySize"),
+		WS:          viper.GetBool("server.httpWS"),
+		Auth:        auth,
+	}, nil
+}
+
+// checkServers connects to the configured RPC endpoints
+func checkServers(ctx context.Context) (string, error) {
+	var dialer net.Dialer
+	var listening []string
+	if ipcPath := viper.GetString("server.ipcPath"); ipcPath != "" {
+		conn, err := dialer.DialContext(ctx, "unix", ipcPath)
+		if err != nil {
+			return strings.Join(listening, ", "), err
+		}
+		conn.Close()
+		listening = append(listening, "ipc")
+	}
+	if httpPath := viper.GetString("server.httpPath"); httpPath != "" {
+		conn, err := dialer.DialContext(ctx, "tcp", httpPath)
+		if err != nil {
+			return strings.Join(listening, ", "), err
+		}
+		conn.Close()
+		listening = append(listening, "http")
+	}
+	return strings.Join(listening, ", ") + " listening", nil
+}
@@ -2,9 +2,14 @@ package cmd
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
 
 	statediff "github.com/cerc-io/plugeth-statediff"
 	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
 	"github.com/cerc-io/plugeth-statediff/indexer/node"
 	"github.com/cerc-io/plugeth-statediff/indexer/shared"
 	"github.com/cerc-io/plugeth-statediff/utils"
@@ -14,6 +19,7 @@ import (
 	"github.com/spf13/viper"
 
 	pkg "github.com/cerc-io/eth-statediff-service/pkg"
+	"github.com/cerc-io/eth-statediff-service/pkg/jsonl"
 	"github.com/cerc-io/eth-statediff-service/pkg/prom"
 )
 
@@ -28,22 +34,130 @@ func createStateDiffService(lvlDBReader pkg.Reader, chainConf *params.ChainConfi
 	}
 
 	logWithCommand.Debug("Creating statediff indexer")
-	db, indexer, err := indexer.NewStateDiffIndexer(context.Background(), chainConf, nodeInfo, conf, true)
+	indexer, dbStats, err := newStateDiffIndexer(chainConf, nodeInfo, conf)
 	if err != nil {
 		logWithCommand.Fatal(err)
 	}
-	if conf.Type() == shared.POSTGRES && viper.GetBool("prom.dbStats") {
-		prom.RegisterDBCollector(viper.GetString("database.name"), db)
-	}
 
 	logWithCommand.Debug("Creating statediff service")
 	sdConf := pkg.ServiceConfig{
 		ServiceWorkers:  viper.GetUint("statediff.serviceWorkers"),
 		TrieWorkers:     viper.GetUint("statediff.trieWorkers"),
 		WorkerQueueSize: viper.GetUint("statediff.workerQueueSize"),
+		BatchSize:       viper.GetUint64("statediff.batchSize"),
 		PreRuns:         setupPreRunRanges(),
+		CarDir:          viper.GetString("car.dir"),
+		CarVersion:      viper.GetInt("car.version"),
+		CarOverwrite:    viper.GetBool("car.overwrite"),
+
+		InteractiveWorkers: viper.GetUint("statediff.interactiveWorkers"),
+		PipelineDepth:      viper.GetUint("statediff.pipelineDepth"),
+		PrefetchNodes:      viper.GetUint("statediff.prefetchNodes"),
+		Throttle: pkg.ThrottleConfig{
+			TargetLatency: viper.GetDuration("throttle.targetLatency"),
+			Interval:      viper.GetDuration("throttle.interval"),
+			MaxDelay:      viper.GetDuration("throttle.maxDelay"),
+			DBStats:       dbStats,
+		},
+		Memory: pkg.MemoryConfig{
+			Budget:   memoryBudget(),
+			Overhead: viper.GetFloat64("memory.overhead"),
+		},
+		Timings: pkg.TimingConfig{
+			History:       viper.GetUint("statediff.timingHistory"),
+			SlowThreshold: viper.GetDuration("statediff.slowBlockThreshold"),
+		},
+		Health: pkg.HealthConfig{
+			StuckDeadline: viper.GetDuration("health.stuckDeadline"),
+			CheckTimeout:  viper.GetDuration("health.checkTimeout"),
+		},
+	}
+	if dbStats != nil {
+		// every open indexer transaction holds a pool connection
+		sdConf.MaxOpenTxs = uint(dbStats.Stats().MaxOpen())
+	}
+	sdConf.CompletionMarker = newCompletionMarker(dbStats)
+	if sdConf.CompletionMarker == nil {
+		for _, preRun := range sdConf.PreRuns {
+			if preRun.SkipExisting {
+				logWithCommand.Fatal("Skipping existing blocks in prerun ranges requires Postgres output or a completion log")
+			}
+		}
+	}
+	service := pkg.NewStateDiffService(lvlDBReader, indexer, sdConf)
+	if db, ok := dbStats.(pkg.Queryer); ok {
+		service.AddReadinessCheck(pkg.HealthCheck{Name: "database", Check: func(ctx context.Context) (string, error) {
+			var one int
+			return "", db.Get(ctx, &one, "SELECT 1")
+		}})
+	}
+	prom.Handle("/healthz", service.LivenessHandler())
+	prom.Handle("/readyz", service.ReadinessHandler())
+	prom.Handle("/status", service.StatusHandler())
+	return service, nil
+}
+
+// newCompletionMarker returns the marker of written blocks: the indexed database itself for Postgres output,
+// otherwise the configured completion log, if any
+func newCompletionMarker(db prom.DBStatsGetter) pkg.CompletionMarker {
+	completionLog := viper.GetString("statediff.completionLog")
+	if db, ok := db.(pkg.Queryer); ok {
+		if completionLog != "" {
+			logWithCommand.Warnf("Ignoring completion log %s, written blocks are looked up in the database", completionLog)
+		}
+		return pkg.NewDBMarker(db)
+	}
+	if completionLog == "" {
+		return nil
+	}
+	logWithCommand.Debugf("Opening completion log %s", completionLog)
+	marker, err := pkg.NewLogMarker(completionLog)
+	if err != nil {
+		logWithCommand.Fatal(err)
+	}
+	return marker
+}
+
+// memoryBudget returns the configured memory budget, or else the configured fraction of the cgroup memory limit
+func memoryBudget() uint64 {
+	if budget := viper.GetUint64("memory.budget"); budget != 0 {
+		return budget
+	}
+	fraction := viper.GetFloat64("memory.cgroupFraction")
+	if fraction == 0 {
+		return 0
+	}
+	limit, err := pkg.CgroupMemoryLimit()
+	if err != nil {
+		logWithCommand.Fatalf("Unable to read cgroup memory limit: %v", err)
+	}
+	if limit == 0 {
+		logWithCommand.Warn("No cgroup memory limit found, memory budget is disabled")
+		return 0
 	}
-	return pkg.NewStateDiffService(lvlDBReader, indexer, sdConf), nil
+	budget := uint64(fraction * float64(limit))
+	logWithCommand.Infof("Using memory budget of %d bytes (%.2f of cgroup limit %d)", budget, fraction, limit)
+	return budget
+}
+
+// newStateDiffIndexer creates the indexer for the configured output, and returns the database
+// connection stats if the output is Postgres
+func newStateDiffIndexer(chainConf *params.ChainConfig, nodeInfo node.Info, conf interfaces.Config) (interfaces.StateDiffIndexer, prom.DBStatsGetter, error) {
+	if jsonConf, ok := conf.(jsonl.Config); ok {
+		indexer, err := jsonl.NewStateDiffIndexer(context.Background(), chainConf, nodeInfo, jsonConf)
+		return indexer, nil, err
+	}
+	db, indexer, err := indexer.NewStateDiffIndexer(context.Background(), chainConf, nodeInfo, conf, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conf.Type() != shared.POSTGRES {
+		return indexer, nil, nil
+	}
+	if viper.GetBool("prom.dbStats") {
+		prom.RegisterDBCollector(viper.GetString("database.name"), db)
+	}
+	return indexer, db, nil
 }
 
 func setupPreRunRanges() []pkg.RangeRequest {
@@ -63,23 +177,32 @@ func setupPreRunRanges() []pkg.RangeRequest {
 		addrs[i] = common.HexToAddress(addrStr)
 	}
 	preRunParams.WatchedAddresses = addrs
+	preRunOpts := pkg.RangeOptions{
+		SkipExisting: viper.GetBool("prerun.skipExisting"),
+		Priority:     pkg.Priority(viper.GetString("prerun.priority")),
+	}
+	if err := preRunOpts.Priority.Validate(); err != nil {
+		logWithCommand.Fatalf("Invalid prerun priority: %v", err)
+	}
 	var rawRanges []blockRange
 	viper.UnmarshalKey("prerun.ranges", &rawRanges)
 	blockRanges := make([]pkg.RangeRequest, len(rawRanges))
 	for i, rawRange := range rawRanges {
 		blockRanges[i] = pkg.RangeRequest{
-			Start:  rawRange[0],
-			Stop:   rawRange[1],
-			Params: preRunParams,
+			Start:        rawRange[0],
+			Stop:         rawRange[1],
+			Params:       preRunParams,
+			RangeOptions: preRunOpts,
 		}
 	}
 	if viper.IsSet("prerun.start") && viper.IsSet("prerun.stop") {
 		hardStart := viper.GetInt("prerun.start")
 		hardStop := viper.GetInt("prerun.stop")
 		blockRanges = append(blockRanges, pkg.RangeRequest{
-			Start:  uint64(hardStart),
-			Stop:   uint64(hardStop),
-			Params: preRunParams,
+			Start:        uint64(hardStart),
+			Stop:         uint64(hardStop),
+			Params:       preRunParams,
+			RangeOptions: preRunOpts,
 		})
 	}
 
@@ -150,3 +273,51 @@ func reportLatestBlock(reader pkg.Reader) {
 		WithField("hash", header.Hash()).
 		Info("Latest block found in levelDB")
 }
+
+// writeRunReport logs the summary of a prerun-only run, and writes it to the configured report file
+func writeRunReport(report *pkg.RunReport) {
+	logWithCommand.
+		WithField("processed", report.Processed).
+		WithField("skipped", report.Skipped).
+		WithField("failed", report.Failed).
+		WithField("blocksPerSecond", report.BlocksPerSecond).
+		Infof("Finished run of %d ranges in %.0fs", len(report.Ranges), report.DurationSeconds)
+	path := viper.GetString("prerun.reportFile")
+	if path == "" {
+		return
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0644)
+	}
+	if err != nil {
+		logWithCommand.Errorf("Unable to write run report to %s: %v", path, err)
+	}
+}
+
+// getStringList returns a list setting, which may also be given as a comma separated string
+// (e.g. in an environment variable)
+func getStringList(key string) []string {
+	var list []string
+	for _, s := range viper.GetStringSlice(key) {
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+	}
+	return list
+}
+
+// readJWTSecret reads a hex encoded 32 byte JWT secret from a file, as written for the engine API
+func readJWTSecret(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := common.FromHex(strings.TrimSpace(string(data)))
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("invalid JWT secret in %s: expected 32 hex encoded bytes", path)
+	}
+	return secret, nil
+}
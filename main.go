@@ -15,7 +15,12 @@
 
 package main
 
-import "github.com/cerc-io/eth-statediff-service/cmd"
+import (
+	// enables go-ethereum's metrics before its packages are initialized
+	_ "github.com/cerc-io/eth-statediff-service/pkg/gethmetrics"
+
+	"github.com/cerc-io/eth-statediff-service/cmd"
+)
 
 func main() {
 	cmd.Execute()
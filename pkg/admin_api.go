@@ -0,0 +1,68 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+)
+
+// AdminAPIName is the namespace used for the service administration API
+const AdminAPIName = "admin"
+
+// AdminAPI provides an RPC interface to adjust the processing of the service at runtime
+type AdminAPI struct {
+	sds *Service
+}
+
+// NewAdminAPI creates an admin rpc interface for the underlying statediff service
+func NewAdminAPI(sds *Service) *AdminAPI {
+	return &AdminAPI{
+		sds: sds,
+	}
+}
+
+// SetServiceWorkers scales the number of service workers
+func (api *AdminAPI) SetServiceWorkers(ctx context.Context, workers uint) (WorkerStatus, error) {
+	if err := api.sds.SetServiceWorkers(workers); err != nil {
+		return WorkerStatus{}, err
+	}
+	return api.sds.WorkerStatus(), nil
+}
+
+// SetTrieWorkers sets the number of subtrie workers used per block
+func (api *AdminAPI) SetTrieWorkers(ctx context.Context, workers uint) (WorkerStatus, error) {
+	if err := api.sds.SetTrieWorkers(workers); err != nil {
+		return WorkerStatus{}, err
+	}
+	return api.sds.WorkerStatus(), nil
+}
+
+// Pause stops processing once the batches in progress are finished, keeping queued ranges
+func (api *AdminAPI) Pause(ctx context.Context) WorkerStatus {
+	api.sds.Pause()
+	return api.sds.WorkerStatus()
+}
+
+// Resume resumes processing of the queued ranges
+func (api *AdminAPI) Resume(ctx context.Context) WorkerStatus {
+	api.sds.Resume()
+	return api.sds.WorkerStatus()
+}
+
+// WorkerStatus returns the current worker configuration
+func (api *AdminAPI) WorkerStatus(ctx context.Context) WorkerStatus {
+	return api.sds.WorkerStatus()
+}
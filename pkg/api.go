@@ -19,6 +19,9 @@ import (
 	"context"
 
 	sd "github.com/cerc-io/plugeth-statediff"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
 )
 
 // APIName is the namespace used for the state diffing service API
@@ -41,16 +44,37 @@ func NewPublicStateDiffAPI(sds *Service) *PublicStateDiffAPI {
 }
 
 // StateDiffAt returns a state diff payload at the specific blockheight
-func (api *PublicStateDiffAPI) StateDiffAt(ctx context.Context, blockNumber uint64, params sd.Params) (*sd.Payload, error) {
-	return api.sds.StateDiffAt(blockNumber, params)
+func (api *PublicStateDiffAPI) StateDiffAt(ctx context.Context, blockNumber uint64, params sd.Params) (payload *sd.Payload, err error) {
+	_, span := tracing.Start(ctx, APIName+"_stateDiffAt", attribute.Int64("block.number", int64(blockNumber)))
+	defer func() { tracing.End(span, err) }()
+	payload, err = api.sds.StateDiffAt(blockNumber, params)
+	recordError(err)
+	return payload, rpcError(err)
 }
 
-// WriteStateDiffAt writes a state diff object directly to DB at the specific blockheight
-func (api *PublicStateDiffAPI) WriteStateDiffAt(ctx context.Context, blockNumber uint64, params sd.Params) error {
-	return api.sds.WriteStateDiffAt(blockNumber, params)
+// WriteStateDiffAt writes a state diff object directly to DB at the specific blockheight.
+// The block is scheduled ahead of queued ranges, as an interactive request unless another priority is given.
+func (api *PublicStateDiffAPI) WriteStateDiffAt(ctx context.Context, blockNumber uint64, params sd.Params, opts *RangeOptions) (err error) {
+	ctx, span := tracing.Start(ctx, APIName+"_writeStateDiffAt", attribute.Int64("block.number", int64(blockNumber)))
+	defer func() { tracing.End(span, err) }()
+	if opts == nil {
+		opts = new(RangeOptions)
+	}
+	return rpcError(api.sds.ScheduleStateDiffAt(ctx, blockNumber, params, opts.Priority))
+}
+
+// SlowBlocks returns the timing breakdown of up to n of the most recently written blocks, slowest first
+func (api *PublicStateDiffAPI) SlowBlocks(ctx context.Context, n uint) []BlockTiming {
+	return api.sds.SlowBlocks(n)
 }
 
 // WriteStateDiffsInRange writes the state diff objects for the provided block range, with the provided params
-func (api *PublicStateDiffAPI) WriteStateDiffsInRange(ctx context.Context, start, stop uint64, params sd.Params) error {
-	return api.sds.WriteStateDiffsInRange(start, stop, params)
+// and optional range options
+func (api *PublicStateDiffAPI) WriteStateDiffsInRange(ctx context.Context, start, stop uint64, params sd.Params, opts *RangeOptions) (err error) {
+	ctx, span := tracing.Start(ctx, APIName+"_writeStateDiffsInRange", tracing.Range(start, stop)...)
+	defer func() { tracing.End(span, err) }()
+	if opts == nil {
+		opts = new(RangeOptions)
+	}
+	return rpcError(api.sds.WriteStateDiffsInRange(ctx, start, stop, params, *opts))
 }
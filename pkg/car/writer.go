@@ -0,0 +1,303 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package car writes IPLD blocks into CAR (content addressable archive) files
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/storage"
+	"github.com/multiformats/go-multihash"
+)
+
+// Supported CAR format versions
+const (
+	V1 = 1
+	V2 = 2
+)
+
+// maximum number of suffixed names tried for a CAR file whose name is taken
+const maxNameSuffix = 1000
+
+// Writer writes blocks into a single CAR file.
+// The CAR header lists the root CIDs up front, while roots are only known once all blocks have been
+// processed, so the sections of committed blocks are spooled to a temporary file and the archive is
+// assembled on Close, by go-car, which also indexes CARv2 archives. The archive is written to a
+// temporary file as well and only then moved into place, so the path never holds a partial CAR.
+type Writer struct {
+	path      string
+	version   int
+	overwrite bool
+
+	spool    *os.File
+	spoolBuf *bufio.Writer
+	roots    []cid.Cid
+
+	mtx sync.Mutex
+}
+
+// Block collects the sections of one Ethereum block until it is committed to a Writer.
+// The sections of a block which is never committed are dropped along with it.
+type Block struct {
+	root cid.Cid
+	buf  bytes.Buffer
+
+	mtx sync.Mutex
+}
+
+// NewWriter creates a Writer for a CAR file of the given version at path.
+// Unless overwrite is set, an existing file is kept and the CAR is written under the first free
+// name with a numbered suffix instead, e.g. 1-10.1.car for 1-10.car.
+func NewWriter(path string, version int, overwrite bool) (*Writer, error) {
+	if version != V1 && version != V2 {
+		return nil, fmt.Errorf("unsupported CAR version %d", version)
+	}
+	// the spool is unique to this writer, so writers of the same path don't interfere
+	spool, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.sections")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		path:      path,
+		version:   version,
+		overwrite: overwrite,
+		spool:     spool,
+		spoolBuf:  bufio.NewWriter(spool),
+	}, nil
+}
+
+// Path returns the path of the CAR file. Once the Writer is closed, this is the name the file was
+// written under.
+func (w *Writer) Path() string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.path
+}
+
+// Commit appends the sections of the block to the CAR and adds its header CID to the roots
+func (w *Writer) Commit(b *Block) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if !b.root.Defined() {
+		return errors.New("CAR block has no header")
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if _, err := w.spoolBuf.Write(b.buf.Bytes()); err != nil {
+		return err
+	}
+	w.roots = append(w.roots, b.root)
+	return nil
+}
+
+// Put writes a block section
+func (b *Block) Put(c cid.Cid, data []byte) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return writeSection(&b.buf, c.Bytes(), data)
+}
+
+// PutIPLD writes a block section for an IPLD given its CID string
+func (b *Block) PutIPLD(cidStr string, data []byte) error {
+	c, err := cid.Decode(cidStr)
+	if err != nil {
+		return err
+	}
+	return b.Put(c, data)
+}
+
+// PutBlock writes the header, transaction and receipt IPLDs of an Ethereum block.
+// The header CID becomes the root of the block once it is committed.
+func (b *Block) PutBlock(block *types.Block, receipts types.Receipts) error {
+	headerRLP, err := rlp.EncodeToBytes(block.Header())
+	if err != nil {
+		return err
+	}
+	headerCID, err := keccak256ToCid(cid.EthBlock, headerRLP)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(headerCID, headerRLP); err != nil {
+		return err
+	}
+	for _, tx := range block.Transactions() {
+		data, err := tx.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := b.putEncoded(cid.EthTx, data); err != nil {
+			return err
+		}
+	}
+	for _, rct := range receipts {
+		data, err := rct.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := b.putEncoded(cid.EthTxReceipt, data); err != nil {
+			return err
+		}
+	}
+	b.mtx.Lock()
+	b.root = headerCID
+	b.mtx.Unlock()
+	return nil
+}
+
+func (b *Block) putEncoded(codec uint64, data []byte) error {
+	c, err := keccak256ToCid(codec, data)
+	if err != nil {
+		return err
+	}
+	return b.Put(c, data)
+}
+
+// Close assembles the CAR file from the header and spooled sections, and removes the spool file.
+// If no blocks were committed no CAR file is written.
+func (w *Writer) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	defer os.Remove(w.spool.Name())
+	defer w.spool.Close()
+
+	if err := w.spoolBuf.Flush(); err != nil {
+		return err
+	}
+	// nothing was completed, a CAR without roots is not valid
+	if len(w.roots) == 0 {
+		return nil
+	}
+	if _, err := w.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(filepath.Dir(w.path), filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// once published the temporary name is gone or only a second link, so this is always safe
+	defer os.Remove(out.Name())
+	if err := w.writeCAR(out); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return w.publish(out.Name())
+}
+
+// writeCAR writes the archive into out from the spooled sections, and syncs it
+func (w *Writer) writeCAR(out *os.File) error {
+	if err := out.Chmod(0644); err != nil {
+		return err
+	}
+	// sections are deduplicated by their whole CID, as equal content may be stored under different codecs
+	opts := []carv2.Option{carv2.UseWholeCIDs(true), carv2.WriteAsCarV1(w.version == V1)}
+	archive, err := storage.NewWritable(out, w.roots, opts...)
+	if err != nil {
+		return err
+	}
+	spool := bufio.NewReader(w.spool)
+	var section []byte
+	for {
+		size, err := binary.ReadUvarint(spool)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if uint64(cap(section)) < size {
+			section = make([]byte, size)
+		}
+		section = section[:size]
+		if _, err := io.ReadFull(spool, section); err != nil {
+			return err
+		}
+		n, c, err := cid.CidFromBytes(section)
+		if err != nil {
+			return err
+		}
+		if err := archive.Put(context.Background(), c.KeyString(), section[n:]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Finalize(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// publish moves the assembled archive to the CAR path. Without overwrite it is linked into place,
+// under the first free suffixed name if the path is taken, e.g. by another writer in the meantime.
+func (w *Writer) publish(tmp string) error {
+	if w.overwrite {
+		return os.Rename(tmp, w.path)
+	}
+	ext := filepath.Ext(w.path)
+	base := strings.TrimSuffix(w.path, ext)
+	path := w.path
+	for n := 1; n <= maxNameSuffix; n++ {
+		err := os.Link(tmp, path)
+		if err == nil {
+			w.path = path
+			return nil
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+		path = fmt.Sprintf("%s.%d%s", base, n, ext)
+	}
+	return fmt.Errorf("CAR file %s and its suffixed names already exist", w.path)
+}
+
+// writeSection writes a varint length-prefixed CID and data pair
+func writeSection(w io.Writer, cidBytes, data []byte) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(cidBytes)+len(data)))
+	if _, err := w.Write(lenBuf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(cidBytes); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func keccak256ToCid(codec uint64, data []byte) (cid.Cid, error) {
+	mh, err := multihash.Encode(crypto.Keccak256(data), multihash.KECCAK_256)
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.NewCidV1(codec, mh), nil
+}
@@ -0,0 +1,348 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package car
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ipfs/go-cid"
+	carv2 "github.com/ipld/go-car/v2"
+	"github.com/ipld/go-car/v2/index"
+)
+
+func testBlock(number int64) (*types.Block, types.Receipts) {
+	header := &types.Header{
+		Number:     big.NewInt(number),
+		Difficulty: big.NewInt(1),
+		GasLimit:   30_000_000,
+		Root:       common.BigToHash(big.NewInt(number)),
+	}
+	to := common.HexToAddress("0x01")
+	tx := types.NewTx(&types.LegacyTx{Nonce: uint64(number), To: &to, Value: big.NewInt(1), Gas: 21000})
+	receipt := &types.Receipt{Status: types.ReceiptStatusSuccessful, CumulativeGasUsed: 21000 * uint64(number), Logs: []*types.Log{}}
+	return types.NewBlockWithHeader(header).WithBody([]*types.Transaction{tx}, nil), types.Receipts{receipt}
+}
+
+// testIPLD returns a state trie node CID and its content
+func testIPLD(t *testing.T, content string) (cid.Cid, []byte) {
+	c, err := keccak256ToCid(cid.EthStateTrie, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, []byte(content)
+}
+
+// carBlock fills a Block with an Ethereum block and a trie node, and returns the expected sections
+func carBlock(t *testing.T, number int64) (*Block, map[cid.Cid][]byte) {
+	block, receipts := testBlock(number)
+	b := new(Block)
+	if err := b.PutBlock(block, receipts); err != nil {
+		t.Fatal(err)
+	}
+	nodeCID, node := testIPLD(t, block.Root().Hex())
+	if err := b.PutIPLD(nodeCID.String(), node); err != nil {
+		t.Fatal(err)
+	}
+	txData, _ := block.Transactions()[0].MarshalBinary()
+	rctData, _ := receipts[0].MarshalBinary()
+	sections := map[cid.Cid][]byte{nodeCID: node}
+	for codec, data := range map[uint64][]byte{cid.EthTx: txData, cid.EthTxReceipt: rctData} {
+		c, err := keccak256ToCid(codec, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections[c] = data
+	}
+	return b, sections
+}
+
+// readCAR reads all roots and sections of a CAR file using go-car
+func readCAR(t *testing.T, path string) (uint64, []cid.Cid, map[cid.Cid][]byte) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := carv2.NewBlockReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := make(map[cid.Cid][]byte)
+	for {
+		blk, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections[blk.Cid()] = blk.RawData()
+	}
+	return r.Version, r.Roots, sections
+}
+
+// assertIndexed checks that the CARv2 file has an index covering the given sections and roots
+func assertIndexed(t *testing.T, path string, sections map[cid.Cid][]byte, roots []cid.Cid) {
+	t.Helper()
+	r, err := carv2.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if !r.Header.HasIndex() {
+		t.Fatal("expected the CARv2 file to have an index")
+	}
+	ir, err := r.IndexReader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.ReadFrom(ir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := append([]cid.Cid{}, roots...)
+	for c := range sections {
+		keys = append(keys, c)
+	}
+	for _, c := range keys {
+		if _, err := index.GetFirst(idx, c); err != nil {
+			t.Errorf("section %s is not indexed: %v", c, err)
+		}
+	}
+}
+
+// assertOnlyCAR checks that no spool or temporary files are left next to the CAR files
+func assertOnlyCAR(t *testing.T, dir string, names ...string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, e := range entries {
+		found = append(found, e.Name())
+	}
+	if len(found) != len(names) {
+		t.Fatalf("expected files %v, found %v", names, found)
+	}
+	for i := range names {
+		if found[i] != names[i] {
+			t.Fatalf("expected files %v, found %v", names, found)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, version := range []int{V1, V2} {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "1-3.car")
+		w, err := NewWriter(path, version, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var roots []cid.Cid
+		expected := make(map[cid.Cid][]byte)
+		for _, number := range []int64{1, 3} {
+			b, sections := carBlock(t, number)
+			if err := w.Commit(b); err != nil {
+				t.Fatal(err)
+			}
+			roots = append(roots, b.root)
+			for c, data := range sections {
+				expected[c] = data
+			}
+		}
+		// block 2 failed and is never committed
+		failed, failedSections := carBlock(t, 2)
+
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		assertOnlyCAR(t, dir, "1-3.car")
+
+		gotVersion, gotRoots, got := readCAR(t, path)
+		if gotVersion != uint64(version) {
+			t.Errorf("expected CARv%d, got v%d", version, gotVersion)
+		}
+		if len(gotRoots) != len(roots) || !gotRoots[0].Equals(roots[0]) || !gotRoots[1].Equals(roots[1]) {
+			t.Errorf("expected roots %v, got %v", roots, gotRoots)
+		}
+		for _, root := range roots {
+			if _, ok := got[root]; !ok {
+				t.Errorf("missing header section %s", root)
+			}
+		}
+		for c, data := range expected {
+			if !bytes.Equal(got[c], data) {
+				t.Errorf("section %s: expected %x, got %x", c, data, got[c])
+			}
+		}
+		if _, ok := got[failed.root]; ok {
+			t.Error("header of the failed block was written")
+		}
+		for c := range failedSections {
+			if _, ok := got[c]; ok {
+				t.Errorf("section %s of the failed block was written", c)
+			}
+		}
+		// 2 headers, 2 transactions, 2 receipts and 2 trie nodes
+		if len(got) != 8 {
+			t.Errorf("expected 8 sections, got %d", len(got))
+		}
+
+		if version == V2 {
+			assertIndexed(t, path, expected, roots)
+		}
+	}
+}
+
+func TestManyRoots(t *testing.T) {
+	var roots []cid.Cid
+	for i := 0; i < 300; i++ {
+		c, _ := testIPLD(t, string(rune(i)))
+		roots = append(roots, c)
+	}
+	path := filepath.Join(t.TempDir(), "roots.car")
+	w, err := NewWriter(path, V1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range roots {
+		// blocks whose header is the root, as far as the writer is concerned
+		b := &Block{root: root}
+		if err := w.Commit(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, gotRoots, _ := readCAR(t, path)
+	if len(gotRoots) != len(roots) {
+		t.Fatalf("expected %d roots, got %d", len(roots), len(gotRoots))
+	}
+	for i := range roots {
+		if !gotRoots[i].Equals(roots[i]) {
+			t.Fatalf("root %d: expected %s, got %s", i, roots[i], gotRoots[i])
+		}
+	}
+}
+
+func TestNoRoots(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWriter(filepath.Join(dir, "empty.car"), V1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Commit(new(Block)); err == nil {
+		t.Error("expected an error committing a block without a header")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertOnlyCAR(t, dir)
+}
+
+func TestExistingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1-1.car")
+	if err := os.WriteFile(path, []byte("previous archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// without overwrite, the existing file is kept and the next free name is used
+	for _, name := range []string{"1-1.1.car", "1-1.2.car"} {
+		w, err := NewWriter(path, V1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := carBlock(t, 1)
+		if err := w.Commit(b); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if w.Path() != filepath.Join(dir, name) {
+			t.Errorf("expected the CAR to be written to %s, got %s", name, w.Path())
+		}
+	}
+	assertOnlyCAR(t, dir, "1-1.1.car", "1-1.2.car", "1-1.car")
+	if data, _ := os.ReadFile(path); string(data) != "previous archive" {
+		t.Error("expected the existing file to be kept")
+	}
+
+	w, err := NewWriter(path, V1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := carBlock(t, 1)
+	if err := w.Commit(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, roots, _ := readCAR(t, path); len(roots) != 1 || !roots[0].Equals(b.root) {
+		t.Errorf("expected the file to be replaced, got roots %v", roots)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1-2.car")
+	first, err := NewWriter(path, V1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewWriter(path, V1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b1, _ := carBlock(t, 1)
+	b2, _ := carBlock(t, 2)
+	if err := first.Commit(b1); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Commit(b2); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the second writer must not replace the first archive
+	if err := second.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assertOnlyCAR(t, dir, "1-2.1.car", "1-2.car")
+	_, roots, sections := readCAR(t, path)
+	if len(roots) != 1 || !roots[0].Equals(b1.root) {
+		t.Errorf("expected the first writer's root, got %v", roots)
+	}
+	if _, ok := sections[b2.root]; ok {
+		t.Error("sections of the second writer leaked into the first archive")
+	}
+	if _, roots, _ := readCAR(t, second.Path()); len(roots) != 1 || !roots[0].Equals(b2.root) {
+		t.Errorf("expected the second writer's root in %s, got %v", second.Path(), roots)
+	}
+}
@@ -6,4 +6,30 @@ type ServiceConfig struct {
 	TrieWorkers     uint
 	WorkerQueueSize uint
 	PreRuns         []RangeRequest
+	// Number of blocks of a range handed out to a worker at a time
+	BatchSize uint64
+	// Number of additional workers reserved for interactive requests
+	InteractiveWorkers uint
+	// Records blocks once they are fully written; required for RangeOptions.SkipExisting
+	CompletionMarker CompletionMarker
+	// Directory to write a CAR file per processed block range into; disabled if empty
+	CarDir     string
+	CarVersion int
+	// Replace existing CAR files instead of failing the range
+	CarOverwrite bool
+	// Maximum number of indexer transactions open at a time, the size of the database connection pool;
+	// unlimited if zero
+	MaxOpenTxs uint
+	// Maximum number of blocks queued between block processing stages
+	PipelineDepth uint
+	// Maximum number of trie nodes to prefetch per upcoming block; disabled if zero
+	PrefetchNodes uint
+	// Adaptive throttling on database commit latency; disabled if the target latency is unset
+	Throttle ThrottleConfig
+	// Memory budget for the blocks in processing; disabled if the budget is unset
+	Memory MemoryConfig
+	// History of per-block timings
+	Timings TimingConfig
+	// Readiness and liveness checks
+	Health HealthConfig
 }
@@ -0,0 +1,110 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"errors"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+// Error is a class of errors, which can be tested for with errors.Is. Each class is counted under its own
+// label in the errors_total metric, and returned to RPC clients with its own JSON-RPC error code.
+type Error struct {
+	msg   string
+	label string
+	code  int
+}
+
+func (e *Error) Error() string { return e.msg }
+
+// ErrorCode returns the JSON-RPC error code of the class
+func (e *Error) ErrorCode() int { return e.code }
+
+var (
+	// ErrBlockNotFound is returned when a block, or its header, hash or total difficulty, is not in the database
+	ErrBlockNotFound = &Error{"block not found", "block_not_found", -32001}
+	// ErrStateUnavailable is returned when the state trie of a block cannot be read, e.g. a trie node is missing
+	ErrStateUnavailable = &Error{"state unavailable", "state_unavailable", -32002}
+	// ErrReceiptsMissing is returned when the receipts of a block are not in the database
+	ErrReceiptsMissing = &Error{"receipts missing", "receipts_missing", -32003}
+	// ErrIndexerWrite is returned when the indexer fails to write or commit a block
+	ErrIndexerWrite = &Error{"indexer write failed", "indexer_write", -32004}
+
+	errorClasses = []*Error{ErrBlockNotFound, ErrStateUnavailable, ErrReceiptsMissing, ErrIndexerWrite}
+)
+
+// label of errors which don't belong to any class
+const otherErrorLabel = "other"
+
+// classifiedError is an error wrapped as one of the classes
+type classifiedError struct {
+	class *Error
+	err   error
+}
+
+func (e *classifiedError) Error() string        { return e.class.msg + ": " + e.err.Error() }
+func (e *classifiedError) Unwrap() error        { return e.err }
+func (e *classifiedError) Is(target error) bool { return target == e.class }
+
+// wrapError marks err as belonging to the class, unless it is nil or already classified
+func wrapError(class *Error, err error) error {
+	if err == nil || classify(err) != nil {
+		return err
+	}
+	return &classifiedError{class, err}
+}
+
+// classify returns the class of err, or nil if it has none
+func classify(err error) *Error {
+	for _, class := range errorClasses {
+		if errors.Is(err, class) {
+			return class
+		}
+	}
+	return nil
+}
+
+// recordError counts a failure in the errors_total metric under the label of its class. Blocks dropped
+// because the service is stopping are not failures, and are not counted.
+func recordError(err error) {
+	if err == nil || errors.Is(err, errPipelineStopped) {
+		return
+	}
+	label := otherErrorLabel
+	if class := classify(err); class != nil {
+		label = class.label
+	}
+	prom.IncErrors(label)
+}
+
+// codedError carries the JSON-RPC error code of the wrapped error's class
+type codedError struct {
+	error
+	code int
+}
+
+func (e *codedError) ErrorCode() int { return e.code }
+func (e *codedError) Unwrap() error  { return e.error }
+
+// rpcError returns err with the error code of its class, as the RPC server only looks for an error code on
+// the returned error itself rather than on the errors it wraps
+func rpcError(err error) error {
+	if class := classify(err); class != nil {
+		return &codedError{err, class.code}
+	}
+	return err
+}
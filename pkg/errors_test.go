@@ -0,0 +1,69 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestErrorClasses(t *testing.T) {
+	for _, c := range []struct {
+		class *Error
+		code  int
+	}{
+		{ErrBlockNotFound, -32001},
+		{ErrStateUnavailable, -32002},
+		{ErrReceiptsMissing, -32003},
+		{ErrIndexerWrite, -32004},
+	} {
+		// classes are found through further wrapping
+		err := fmt.Errorf("writing block 1: %w", wrapError(c.class, errors.New("cause")))
+		if class := classify(err); class != c.class {
+			t.Errorf("%s: expected the error to be classified, got %v", c.class, class)
+		}
+		var coded interface{ ErrorCode() int }
+		if !errors.As(rpcError(err), &coded) || coded.ErrorCode() != c.code {
+			t.Errorf("%s: expected error code %d", c.class, c.code)
+		}
+		if !errors.Is(rpcError(err), c.class) {
+			t.Errorf("%s: expected the RPC error to keep its class", c.class)
+		}
+	}
+}
+
+func TestErrorWrapping(t *testing.T) {
+	if wrapError(ErrIndexerWrite, nil) != nil {
+		t.Error("expected a nil error to stay nil")
+	}
+	// an error keeps the class it was first given
+	err := wrapError(ErrIndexerWrite, wrapError(ErrStateUnavailable, errors.New("missing trie node")))
+	if classify(err) != ErrStateUnavailable {
+		t.Errorf("expected the inner class to be kept, got %v", classify(err))
+	}
+	if err.Error() != "state unavailable: missing trie node" {
+		t.Errorf("unexpected message %q", err.Error())
+	}
+
+	plain := errors.New("other")
+	if classify(plain) != nil {
+		t.Error("expected an unclassified error to have no class")
+	}
+	if rpcError(plain) != plain {
+		t.Error("expected an unclassified error to be returned as is")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package gethmetrics enables go-ethereum's metrics according to the prom.gethMetrics setting.
+//
+// go-ethereum creates its meters, such as those of the trie cache, when its packages are initialized,
+// and they stay disabled unless metrics are enabled by then. The setting is therefore read here, from
+// the command line, the environment and the config file in the same order of precedence as the rest
+// of the configuration, before the command line is parsed. This package must be initialized before
+// go-ethereum's trie packages, so it only depends on go-ethereum's metrics package, and is imported
+// first by main.
+package gethmetrics
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/pelletier/go-toml"
+)
+
+const (
+	// Flag, environment variable and config key of the setting
+	Flag   = "prom-geth-metrics"
+	EnvVar = "PROM_GETH_METRICS"
+	Key    = "prom.gethMetrics"
+
+	configFlag = "config"
+)
+
+func init() {
+	if enabled(os.Args[1:]) {
+		metrics.Enabled = true
+	}
+}
+
+// enabled reads the setting from the command line arguments, the environment or the config file
+func enabled(args []string) bool {
+	if value, ok := flagValue(args, Flag, true); ok {
+		return parseBool(value)
+	}
+	if value, ok := os.LookupEnv(EnvVar); ok {
+		return parseBool(value)
+	}
+	if path, ok := flagValue(args, configFlag, false); ok {
+		return configValue(path)
+	}
+	return false
+}
+
+// flagValue returns the value of the last occurrence of the flag in args. A boolean flag may be
+// given without a value.
+func flagValue(args []string, name string, boolean bool) (value string, found bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "--"+name) {
+			continue
+		}
+		switch rest := arg[len(name)+2:]; {
+		case strings.HasPrefix(rest, "="):
+			value, found = rest[1:], true
+		case rest != "":
+			// another flag with the same prefix
+		case boolean:
+			value, found = "true", true
+		case i+1 < len(args):
+			i++
+			value, found = args[i], true
+		}
+	}
+	return value, found
+}
+
+// configValue reads the setting from the TOML config file; an unreadable file is reported once the
+// configuration is loaded
+func configValue(path string) bool {
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		return false
+	}
+	section, key, _ := strings.Cut(Key, ".")
+	// viper's keys are case insensitive
+	for _, name := range tree.Keys() {
+		sub, ok := tree.Get(name).(*toml.Tree)
+		if !ok || !strings.EqualFold(name, section) {
+			continue
+		}
+		for _, subName := range sub.Keys() {
+			if strings.EqualFold(subName, key) {
+				switch v := sub.Get(subName).(type) {
+				case bool:
+					return v
+				case string:
+					return parseBool(v)
+				}
+			}
+		}
+	}
+	return false
+}
+
+func parseBool(value string) bool {
+	b, _ := strconv.ParseBool(value)
+	return b
+}
@@ -0,0 +1,63 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package gethmetrics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEnabled(t *testing.T) {
+	on := writeConfig(t, "[prom]\n    metrics = true\n    gethMetrics = true\n")
+	off := writeConfig(t, "[prom]\n    gethmetrics = false\n")
+	for _, c := range []struct {
+		name    string
+		args    []string
+		env     string
+		enabled bool
+	}{
+		{"unset", []string{"serve"}, "", false},
+		{"flag", []string{"serve", "--prom-geth-metrics"}, "", true},
+		{"flag with value", []string{"--prom-geth-metrics=false", "serve"}, "true", false},
+		{"flag with another name", []string{"--prom-geth-metrics-other"}, "", false},
+		{"environment", []string{"serve"}, "true", true},
+		{"config file", []string{"serve", "--config", on}, "", true},
+		{"config file with value", []string{"serve", "--config=" + on}, "", true},
+		{"config file disabled", []string{"serve", "--config", off}, "", false},
+		{"environment over config file", []string{"serve", "--config", on}, "false", false},
+		{"missing config file", []string{"serve", "--config", on + ".missing"}, "", false},
+		{"after terminator", []string{"serve", "--", "--prom-geth-metrics"}, "", false},
+	} {
+		if c.env == "" {
+			os.Unsetenv(EnvVar)
+		} else {
+			t.Setenv(EnvVar, c.env)
+		}
+		if enabled := enabled(c.args); enabled != c.enabled {
+			t.Errorf("%s: expected enabled to be %v", c.name, c.enabled)
+		}
+	}
+}
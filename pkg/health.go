@@ -0,0 +1,207 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	healthOK        = "ok"
+	healthUnhealthy = "unhealthy"
+
+	defaultCheckTimeout = 5 * time.Second
+)
+
+// HealthCheck is a named readiness check, returning a short description of the checked state
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) (string, error)
+}
+
+// HealthConfig controls the readiness and liveness checks
+type HealthConfig struct {
+	// Maximum time a worker may spend on a single block before the service is reported as not live;
+	// disabled if zero
+	StuckDeadline time.Duration
+	// Timeout of each readiness check
+	CheckTimeout time.Duration
+}
+
+// CheckResult is the outcome of a single readiness check
+type CheckResult struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Readiness reports whether the service is able to process requests
+type Readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// StuckWorker describes a worker which has not finished a block within the deadline
+type StuckWorker struct {
+	Worker int       `json:"worker"`
+	Job    uint64    `json:"job"`
+	Block  uint64    `json:"block"`
+	Since  time.Time `json:"since"`
+}
+
+// Liveness reports whether the workers are making progress
+type Liveness struct {
+	Status        string        `json:"status"`
+	BusyWorkers   int           `json:"busyWorkers"`
+	StuckDeadline string        `json:"stuckDeadline,omitempty"`
+	StuckWorkers  []StuckWorker `json:"stuckWorkers,omitempty"`
+}
+
+// healthChecks holds the readiness checks registered with the service
+type healthChecks struct {
+	mtx    sync.Mutex
+	checks []HealthCheck
+}
+
+// AddReadinessCheck registers an additional readiness check, e.g. for the database or the RPC servers
+func (sds *Service) AddReadinessCheck(check HealthCheck) {
+	sds.checks.mtx.Lock()
+	defer sds.checks.mtx.Unlock()
+	sds.checks.checks = append(sds.checks.checks, check)
+}
+
+// Readiness runs the readiness checks: reading the head header from the Reader, plus the registered checks
+func (sds *Service) Readiness(ctx context.Context) Readiness {
+	sds.checks.mtx.Lock()
+	checks := append([]HealthCheck{{Name: "reader", Check: sds.checkReader}}, sds.checks.checks...)
+	sds.checks.mtx.Unlock()
+
+	timeout := sds.health.CheckTimeout
+	if timeout == 0 {
+		timeout = defaultCheckTimeout
+	}
+	results := make([]CheckResult, len(checks))
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func(i int, check HealthCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			results[i] = runCheck(ctx, check)
+		}(i, check)
+	}
+	wg.Wait()
+
+	r := Readiness{Status: healthOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, check := range checks {
+		r.Checks[check.Name] = results[i]
+		if !results[i].OK {
+			r.Status = healthUnhealthy
+		}
+	}
+	return r
+}
+
+// runCheck runs the check, giving up once ctx is done
+func runCheck(ctx context.Context, check HealthCheck) CheckResult {
+	type outcome struct {
+		detail string
+		err    error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		detail, err := check.Check(ctx)
+		done <- outcome{detail, err}
+	}()
+	select {
+	case o := <-done:
+		if o.err != nil {
+			return CheckResult{Detail: o.detail, Error: o.err.Error()}
+		}
+		return CheckResult{OK: true, Detail: o.detail}
+	case <-ctx.Done():
+		return CheckResult{Error: ctx.Err().Error()}
+	}
+}
+
+// checkReader reads the head header
+func (sds *Service) checkReader(ctx context.Context) (string, error) {
+	header, err := sds.lvlDBReader.GetLatestHeader()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("head block %d", header.Number.Uint64()), nil
+}
+
+// Liveness reports the workers which have spent more than the deadline on a single block
+func (sds *Service) Liveness() Liveness {
+	l := Liveness{Status: healthOK}
+	if sds.health.StuckDeadline > 0 {
+		l.StuckDeadline = sds.health.StuckDeadline.String()
+	}
+	sds.workersMtx.Lock()
+	defer sds.workersMtx.Unlock()
+	for id, p := range sds.progress {
+		job, block, since, busy := p.current()
+		if !busy {
+			continue
+		}
+		l.BusyWorkers++
+		if sds.health.StuckDeadline > 0 && time.Since(since) > sds.health.StuckDeadline {
+			l.Status = healthUnhealthy
+			l.StuckWorkers = append(l.StuckWorkers, StuckWorker{Worker: id, Job: job.id, Block: block, Since: since})
+		}
+	}
+	sort.Slice(l.StuckWorkers, func(i, j int) bool {
+		return l.StuckWorkers[i].Worker < l.StuckWorkers[j].Worker
+	})
+	return l
+}
+
+// ReadinessHandler serves the readiness report, with status 503 if any check failed
+func (sds *Service) ReadinessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := sds.Readiness(r.Context())
+		writeHealth(w, report.Status, report)
+	})
+}
+
+// LivenessHandler serves the liveness report, with status 503 if a worker is stuck
+func (sds *Service) LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := sds.Liveness()
+		writeHealth(w, report.Status, report)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, status string, report interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if status != healthOK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		logrus.Errorf("error writing health report: %v", err)
+	}
+}
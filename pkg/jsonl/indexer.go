@@ -0,0 +1,304 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jsonl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/dump"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/cerc-io/plugeth-statediff/indexer/shared"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/sirupsen/logrus"
+)
+
+// Config holds the destination for the JSON Lines output
+type Config struct {
+	// Dump receives the records if Path is unset; it is not closed by the indexer
+	Dump io.Writer
+	// Path is a file which the records are appended to, opened and closed by the indexer
+	Path string
+}
+
+// Type satisfies interfaces.Config; JSON Lines output is a flavour of the dump database type
+func (c Config) Type() shared.DBType {
+	return shared.DUMP
+}
+
+// StateDiffIndexer writes statediff objects as newline-delimited JSON records.
+// Methods not concerned with writing diffs (watched addresses etc.) are served by an embedded
+// dump indexer which discards its output.
+type StateDiffIndexer struct {
+	interfaces.StateDiffIndexer
+
+	chainConfig *params.ChainConfig
+	dump        io.Writer
+	dumpMtx     sync.Mutex
+	// file opened for Config.Path, if any
+	file *os.File
+}
+
+var _ interfaces.StateDiffIndexer = &StateDiffIndexer{}
+
+// NewStateDiffIndexer creates a JSON Lines StateDiffIndexer
+func NewStateDiffIndexer(ctx context.Context, chainConfig *params.ChainConfig, nodeInfo node.Info, config Config) (*StateDiffIndexer, error) {
+	_, base, err := indexer.NewStateDiffIndexer(ctx, chainConfig, nodeInfo, dump.Config{Dump: dump.Discard}, true)
+	if err != nil {
+		return nil, err
+	}
+	sdi := &StateDiffIndexer{
+		StateDiffIndexer: base,
+		chainConfig:      chainConfig,
+		dump:             config.Dump,
+	}
+	if config.Path != "" {
+		sdi.file, err = os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		sdi.dump = sdi.file
+	}
+	return sdi, nil
+}
+
+// PushBlock buffers block, transaction, receipt and log records for the block.
+// Nothing is written until the returned Batch is submitted.
+func (sdi *StateDiffIndexer) PushBlock(block *types.Block, receipts types.Receipts, totalDifficulty *big.Int) (interfaces.Batch, error) {
+	if len(receipts) != 0 && len(receipts) != len(block.Transactions()) {
+		return nil, fmt.Errorf("expected number of transactions (%d) does not match number of receipts (%d)",
+			len(block.Transactions()), len(receipts))
+	}
+	tx := newBatch(sdi, block)
+
+	header := block.Header()
+	blk := Block{
+		ParentHash:  header.ParentHash,
+		UncleHash:   header.UncleHash,
+		Coinbase:    header.Coinbase,
+		StateRoot:   header.Root,
+		TxRoot:      header.TxHash,
+		ReceiptRoot: header.ReceiptHash,
+		Difficulty:  (*hexutil.Big)(header.Difficulty),
+		GasLimit:    header.GasLimit,
+		GasUsed:     header.GasUsed,
+		BaseFee:     (*hexutil.Big)(header.BaseFee),
+		Timestamp:   header.Time,
+		TxCount:     len(block.Transactions()),
+		UncleCount:  len(block.Uncles()),
+	}
+	if totalDifficulty != nil {
+		blk.TotalDifficulty = (*hexutil.Big)(totalDifficulty)
+	}
+	if err := tx.add(BlockRecord, blk); err != nil {
+		return nil, err
+	}
+
+	signer := types.MakeSigner(sdi.chainConfig, block.Number())
+	for i, trx := range block.Transactions() {
+		from, err := types.Sender(signer, trx)
+		if err != nil {
+			return nil, fmt.Errorf("error deriving tx sender: %w", err)
+		}
+		if err := tx.add(TransactionRecord, Transaction{
+			Hash:     trx.Hash(),
+			Index:    i,
+			Type:     trx.Type(),
+			From:     from,
+			To:       trx.To(),
+			Nonce:    trx.Nonce(),
+			Value:    (*hexutil.Big)(trx.Value()),
+			Gas:      trx.Gas(),
+			GasPrice: (*hexutil.Big)(trx.GasPrice()),
+			Size:     trx.Size(),
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	for i, rct := range receipts {
+		txHash := block.Transactions()[i].Hash()
+		r := Receipt{
+			TxHash:            txHash,
+			TxIndex:           uint(i),
+			Status:            rct.Status,
+			PostState:         rct.PostState,
+			CumulativeGasUsed: rct.CumulativeGasUsed,
+			GasUsed:           rct.GasUsed,
+			LogCount:          len(rct.Logs),
+		}
+		if rct.ContractAddress != (common.Address{}) {
+			contract := rct.ContractAddress
+			r.ContractAddress = &contract
+		}
+		if err := tx.add(ReceiptRecord, r); err != nil {
+			return nil, err
+		}
+		for _, l := range rct.Logs {
+			if err := tx.add(LogRecord, Log{
+				TxHash:  txHash,
+				TxIndex: uint(i),
+				Index:   l.Index,
+				Address: l.Address,
+				Topics:  l.Topics,
+				Data:    l.Data,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return tx, nil
+}
+
+// PushStateNode buffers a state_node record, and a storage_node record for each of its storage diffs
+func (sdi *StateDiffIndexer) PushStateNode(batch interfaces.Batch, stateNode sdtypes.StateLeafNode, headerID string) error {
+	tx, ok := batch.(*Batch)
+	if !ok {
+		return fmt.Errorf("jsonl: batch is expected to be of type %T, got %T", &Batch{}, batch)
+	}
+	sn := StateNode{
+		LeafKey: stateNode.AccountWrapper.LeafKey,
+		CID:     stateNode.AccountWrapper.CID,
+		Removed: stateNode.Removed,
+	}
+	if account := stateNode.AccountWrapper.Account; !stateNode.Removed && account != nil {
+		root := account.Root
+		sn.Nonce = account.Nonce
+		sn.Balance = (*hexutil.Big)(account.Balance)
+		sn.CodeHash = account.CodeHash
+		sn.StorageRoot = &root
+	}
+	if err := tx.add(StateNodeRecord, sn); err != nil {
+		return err
+	}
+	for _, storage := range stateNode.StorageDiff {
+		if err := tx.add(StorageNodeRecord, StorageNode{
+			StateLeafKey: stateNode.AccountWrapper.LeafKey,
+			LeafKey:      storage.LeafKey,
+			CID:          storage.CID,
+			Removed:      storage.Removed,
+			Value:        storage.Value,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PushIPLD buffers an ipld record
+func (sdi *StateDiffIndexer) PushIPLD(batch interfaces.Batch, ipld sdtypes.IPLD) error {
+	tx, ok := batch.(*Batch)
+	if !ok {
+		return fmt.Errorf("jsonl: batch is expected to be of type %T, got %T", &Batch{}, batch)
+	}
+	return tx.add(IPLDRecord, IPLD{
+		CID:  ipld.CID,
+		Data: ipld.Content,
+	})
+}
+
+// Close satisfies io.Closer; the output is only closed if it is a file opened by the indexer
+func (sdi *StateDiffIndexer) Close() error {
+	if err := sdi.StateDiffIndexer.Close(); err != nil {
+		return err
+	}
+	if sdi.file == nil {
+		return nil
+	}
+	return sdi.file.Close()
+}
+
+func (sdi *StateDiffIndexer) write(p []byte) error {
+	sdi.dumpMtx.Lock()
+	defer sdi.dumpMtx.Unlock()
+	_, err := sdi.dump.Write(p)
+	return err
+}
+
+// Batch buffers the encoded records of a single block so that they are written out contiguously,
+// and only if the block was processed successfully
+type Batch struct {
+	sdi *StateDiffIndexer
+
+	blockNumber uint64
+	blockHash   common.Hash
+
+	buf bytes.Buffer
+	enc *json.Encoder
+	mtx sync.Mutex
+}
+
+func newBatch(sdi *StateDiffIndexer, block *types.Block) *Batch {
+	tx := &Batch{
+		sdi:         sdi,
+		blockNumber: block.NumberU64(),
+		blockHash:   block.Hash(),
+	}
+	tx.enc = json.NewEncoder(&tx.buf)
+	return tx
+}
+
+func (tx *Batch) add(typ RecordType, data interface{}) error {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+	// json.Encoder terminates each value with a newline
+	return tx.enc.Encode(Record{
+		Type:        typ,
+		BlockNumber: tx.blockNumber,
+		BlockHash:   tx.blockHash,
+		Data:        data,
+	})
+}
+
+// Submit writes the buffered records out
+func (tx *Batch) Submit() error {
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+	if tx.buf.Len() == 0 {
+		return nil
+	}
+	err := tx.sdi.write(tx.buf.Bytes())
+	tx.buf.Reset()
+	return err
+}
+
+// BlockNumber returns the number of the block this batch holds records for
+func (tx *Batch) BlockNumber() string {
+	return fmt.Sprint(tx.blockNumber)
+}
+
+// RollbackOnFailure drops the buffered records if err is not nil
+func (tx *Batch) RollbackOnFailure(err error) {
+	if err == nil {
+		return
+	}
+	tx.mtx.Lock()
+	defer tx.mtx.Unlock()
+	logrus.WithField("block", tx.blockNumber).Debugf("discarding buffered records: %v", err)
+	tx.buf.Reset()
+}
@@ -0,0 +1,369 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jsonl
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+var (
+	testKey, _      = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	testAddress     = crypto.PubkeyToAddress(testKey.PublicKey)
+	testContract    = common.HexToAddress("0x00000000000000000000000000000000000051ab")
+	testChainConfig = params.AllEthashProtocolChanges
+)
+
+// baseIndexer stands in for the embedded dump indexer
+type baseIndexer struct {
+	interfaces.StateDiffIndexer
+	closed bool
+}
+
+func (b *baseIndexer) Close() error {
+	b.closed = true
+	return nil
+}
+
+// closeRecorder is a dump destination which records whether it was closed
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func newTestIndexer(dump *bytes.Buffer) *StateDiffIndexer {
+	return &StateDiffIndexer{
+		StateDiffIndexer: &baseIndexer{},
+		chainConfig:      testChainConfig,
+		dump:             dump,
+	}
+}
+
+// testBlock returns a block at height 1 with one transaction, and its receipt carrying one log
+func testBlock(t *testing.T) (*types.Block, types.Receipts) {
+	signer := types.MakeSigner(testChainConfig, big.NewInt(1))
+	tx, err := types.SignTx(types.NewTransaction(0, testContract, big.NewInt(1), 50000, big.NewInt(1), nil), signer, testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt := &types.Receipt{
+		Status:            types.ReceiptStatusSuccessful,
+		CumulativeGasUsed: 21000,
+		GasUsed:           21000,
+		TxHash:            tx.Hash(),
+		Logs: []*types.Log{{
+			Address: testContract,
+			Topics:  []common.Hash{common.HexToHash("0x01")},
+			Data:    []byte{0x02},
+		}},
+	}
+	header := &types.Header{Number: big.NewInt(1), Difficulty: big.NewInt(2), GasLimit: 8000000, BaseFee: big.NewInt(1)}
+	receipts := types.Receipts{receipt}
+	return types.NewBlock(header, []*types.Transaction{tx}, nil, receipts, trie.NewStackTrie(nil)), receipts
+}
+
+// readRecords decodes the records written to the dump
+func readRecords(t *testing.T, data []byte) []map[string]json.RawMessage {
+	var records []map[string]json.RawMessage
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("invalid record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func recordType(t *testing.T, record map[string]json.RawMessage) RecordType {
+	var typ RecordType
+	if err := json.Unmarshal(record["type"], &typ); err != nil {
+		t.Fatal(err)
+	}
+	return typ
+}
+
+func TestRecords(t *testing.T) {
+	var dump bytes.Buffer
+	sdi := newTestIndexer(&dump)
+	block, receipts := testBlock(t)
+
+	tx, err := sdi.PushBlock(block, receipts, big.NewInt(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateNode := sdtypes.StateLeafNode{
+		AccountWrapper: sdtypes.AccountWrapper{
+			Account: &types.StateAccount{Nonce: 1, Balance: big.NewInt(5), Root: common.HexToHash("0x03"), CodeHash: crypto.Keccak256(nil)},
+			LeafKey: crypto.Keccak256(testAddress.Bytes()),
+			CID:     "state-cid",
+		},
+		StorageDiff: []sdtypes.StorageLeafNode{{LeafKey: []byte{0x04}, Value: []byte{0x05}, CID: "storage-cid"}},
+	}
+	if err := sdi.PushStateNode(tx, stateNode, block.Hash().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdi.PushIPLD(tx, sdtypes.IPLD{CID: "ipld-cid", Content: []byte{0x06}}); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Len() != 0 {
+		t.Fatalf("records were written before the batch was submitted: %q", dump.String())
+	}
+	if err := tx.Submit(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, dump.Bytes())
+	expected := []RecordType{BlockRecord, TransactionRecord, ReceiptRecord, LogRecord, StateNodeRecord, StorageNodeRecord, IPLDRecord}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %d records, got %d: %q", len(expected), len(records), dump.String())
+	}
+	for i, record := range records {
+		if typ := recordType(t, record); typ != expected[i] {
+			t.Errorf("record %d: expected type %s, got %s", i, expected[i], typ)
+		}
+		var number uint64
+		var hash common.Hash
+		json.Unmarshal(record["blockNumber"], &number)
+		json.Unmarshal(record["blockHash"], &hash)
+		if number != 1 || hash != block.Hash() {
+			t.Errorf("record %d: expected block 1 %s, got %d %s", i, block.Hash(), number, hash)
+		}
+	}
+
+	var blk Block
+	if err := json.Unmarshal(records[0]["data"], &blk); err != nil {
+		t.Fatal(err)
+	}
+	if blk.TxCount != 1 || blk.TotalDifficulty.ToInt().Int64() != 3 || blk.StateRoot != block.Root() {
+		t.Errorf("unexpected block record %+v", blk)
+	}
+	var trx Transaction
+	if err := json.Unmarshal(records[1]["data"], &trx); err != nil {
+		t.Fatal(err)
+	}
+	if trx.From != testAddress || *trx.To != testContract || trx.Hash != block.Transactions()[0].Hash() {
+		t.Errorf("unexpected transaction record %+v", trx)
+	}
+	var lg Log
+	if err := json.Unmarshal(records[3]["data"], &lg); err != nil {
+		t.Fatal(err)
+	}
+	if lg.Address != testContract || len(lg.Topics) != 1 || !bytes.Equal(lg.Data, []byte{0x02}) {
+		t.Errorf("unexpected log record %+v", lg)
+	}
+	var sn StateNode
+	if err := json.Unmarshal(records[4]["data"], &sn); err != nil {
+		t.Fatal(err)
+	}
+	if sn.CID != "state-cid" || sn.Nonce != 1 || sn.Balance.ToInt().Int64() != 5 || *sn.StorageRoot != common.HexToHash("0x03") {
+		t.Errorf("unexpected state node record %+v", sn)
+	}
+	var storage StorageNode
+	if err := json.Unmarshal(records[5]["data"], &storage); err != nil {
+		t.Fatal(err)
+	}
+	if storage.CID != "storage-cid" || !bytes.Equal(storage.StateLeafKey, stateNode.AccountWrapper.LeafKey) {
+		t.Errorf("unexpected storage node record %+v", storage)
+	}
+}
+
+func TestRemovedStateNode(t *testing.T) {
+	var dump bytes.Buffer
+	sdi := newTestIndexer(&dump)
+	block, receipts := testBlock(t)
+	tx, err := sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateNode := sdtypes.StateLeafNode{Removed: true, AccountWrapper: sdtypes.AccountWrapper{LeafKey: []byte{0x01}}}
+	if err := sdi.PushStateNode(tx, stateNode, block.Hash().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	records := readRecords(t, dump.Bytes())
+	var sn StateNode
+	if err := json.Unmarshal(records[len(records)-1]["data"], &sn); err != nil {
+		t.Fatal(err)
+	}
+	if !sn.Removed || sn.Balance != nil || sn.StorageRoot != nil {
+		t.Errorf("unexpected removed state node record %+v", sn)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	var dump bytes.Buffer
+	sdi := newTestIndexer(&dump)
+	block, receipts := testBlock(t)
+
+	tx, err := sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a nil error does not roll back
+	tx.RollbackOnFailure(nil)
+	if err := tx.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	written := dump.Len()
+	if written == 0 {
+		t.Fatal("no records written")
+	}
+
+	tx, err = sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sdi.PushIPLD(tx, sdtypes.IPLD{CID: "ipld-cid", Content: []byte{0x06}}); err != nil {
+		t.Fatal(err)
+	}
+	tx.RollbackOnFailure(errors.New("failed"))
+	if err := tx.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	if dump.Len() != written {
+		t.Errorf("rolled back records were written: %q", dump.Bytes()[written:])
+	}
+}
+
+func TestBatchesAreWrittenWhole(t *testing.T) {
+	var dump bytes.Buffer
+	sdi := newTestIndexer(&dump)
+	block, receipts := testBlock(t)
+
+	first, err := sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// interleaved pushes are written out per batch
+	if err := sdi.PushIPLD(first, sdtypes.IPLD{CID: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdi.PushIPLD(second, sdtypes.IPLD{CID: "second"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	var cids []string
+	for _, record := range readRecords(t, dump.Bytes()) {
+		if recordType(t, record) != IPLDRecord {
+			continue
+		}
+		var ipld IPLD
+		json.Unmarshal(record["data"], &ipld)
+		cids = append(cids, ipld.CID)
+	}
+	if len(cids) != 2 || cids[0] != "second" || cids[1] != "first" {
+		t.Errorf("expected the IPLDs of the batches in order of submission, got %v", cids)
+	}
+}
+
+func TestPushErrors(t *testing.T) {
+	sdi := newTestIndexer(new(bytes.Buffer))
+	block, receipts := testBlock(t)
+	if _, err := sdi.PushBlock(block, append(receipts, receipts...), nil); err == nil {
+		t.Error("expected an error for a receipt count mismatch")
+	}
+	var other interfaces.Batch
+	if err := sdi.PushIPLD(other, sdtypes.IPLD{}); err == nil {
+		t.Error("expected an error for a batch of another indexer")
+	}
+	if err := sdi.PushStateNode(other, sdtypes.StateLeafNode{}, ""); err == nil {
+		t.Error("expected an error for a batch of another indexer")
+	}
+}
+
+func TestCloseLeavesDumpOpen(t *testing.T) {
+	dump := new(closeRecorder)
+	base := &baseIndexer{}
+	sdi := &StateDiffIndexer{StateDiffIndexer: base, chainConfig: testChainConfig, dump: dump}
+	if err := sdi.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !base.closed {
+		t.Error("embedded indexer was not closed")
+	}
+	if dump.closed {
+		t.Error("dump destination not opened by the indexer was closed")
+	}
+}
+
+func TestCloseDumpFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.jsonl")
+	if err := os.WriteFile(path, []byte("existing\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sdi, err := NewStateDiffIndexer(context.Background(), testChainConfig, node.Info{}, Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, receipts := testBlock(t)
+	tx, err := sdi.PushBlock(block, receipts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Submit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sdi.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sdi.file.Write([]byte{0}); err == nil {
+		t.Error("dump file opened by the indexer was not closed")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("existing\n")) {
+		t.Errorf("dump file was not appended to: %q", data)
+	}
+	if records := readRecords(t, data[len("existing\n"):]); len(records) != 4 {
+		t.Errorf("expected 4 records in the dump file, got %d", len(records))
+	}
+}
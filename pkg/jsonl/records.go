@@ -0,0 +1,122 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package jsonl
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// RecordType identifies the kind of object carried by a Record
+type RecordType string
+
+const (
+	BlockRecord       RecordType = "block"
+	TransactionRecord RecordType = "transaction"
+	ReceiptRecord     RecordType = "receipt"
+	LogRecord         RecordType = "log"
+	StateNodeRecord   RecordType = "state_node"
+	StorageNodeRecord RecordType = "storage_node"
+	IPLDRecord        RecordType = "ipld"
+)
+
+// Record is a single line of output; every record carries the block it belongs to
+type Record struct {
+	Type        RecordType  `json:"type"`
+	BlockNumber uint64      `json:"blockNumber"`
+	BlockHash   common.Hash `json:"blockHash"`
+	Data        interface{} `json:"data"`
+}
+
+// Block is the payload of a block record
+type Block struct {
+	ParentHash      common.Hash    `json:"parentHash"`
+	UncleHash       common.Hash    `json:"uncleHash"`
+	Coinbase        common.Address `json:"coinbase"`
+	StateRoot       common.Hash    `json:"stateRoot"`
+	TxRoot          common.Hash    `json:"txRoot"`
+	ReceiptRoot     common.Hash    `json:"receiptRoot"`
+	Difficulty      *hexutil.Big   `json:"difficulty"`
+	TotalDifficulty *hexutil.Big   `json:"totalDifficulty,omitempty"`
+	GasLimit        uint64         `json:"gasLimit"`
+	GasUsed         uint64         `json:"gasUsed"`
+	BaseFee         *hexutil.Big   `json:"baseFee,omitempty"`
+	Timestamp       uint64         `json:"timestamp"`
+	TxCount         int            `json:"txCount"`
+	UncleCount      int            `json:"uncleCount"`
+}
+
+// Transaction is the payload of a transaction record
+type Transaction struct {
+	Hash     common.Hash     `json:"hash"`
+	Index    int             `json:"index"`
+	Type     uint8           `json:"type"`
+	From     common.Address  `json:"from"`
+	To       *common.Address `json:"to"`
+	Nonce    uint64          `json:"nonce"`
+	Value    *hexutil.Big    `json:"value"`
+	Gas      uint64          `json:"gas"`
+	GasPrice *hexutil.Big    `json:"gasPrice"`
+	Size     uint64          `json:"size"`
+}
+
+// Receipt is the payload of a receipt record
+type Receipt struct {
+	TxHash            common.Hash     `json:"txHash"`
+	TxIndex           uint            `json:"txIndex"`
+	Status            uint64          `json:"status"`
+	PostState         hexutil.Bytes   `json:"postState,omitempty"`
+	CumulativeGasUsed uint64          `json:"cumulativeGasUsed"`
+	GasUsed           uint64          `json:"gasUsed"`
+	ContractAddress   *common.Address `json:"contractAddress,omitempty"`
+	LogCount          int             `json:"logCount"`
+}
+
+// Log is the payload of a log record
+type Log struct {
+	TxHash  common.Hash    `json:"txHash"`
+	TxIndex uint           `json:"txIndex"`
+	Index   uint           `json:"index"`
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+}
+
+// StateNode is the payload of a state_node record
+type StateNode struct {
+	LeafKey     hexutil.Bytes `json:"leafKey"`
+	CID         string        `json:"cid"`
+	Removed     bool          `json:"removed"`
+	Nonce       uint64        `json:"nonce,omitempty"`
+	Balance     *hexutil.Big  `json:"balance,omitempty"`
+	CodeHash    hexutil.Bytes `json:"codeHash,omitempty"`
+	StorageRoot *common.Hash  `json:"storageRoot,omitempty"`
+}
+
+// StorageNode is the payload of a storage_node record
+type StorageNode struct {
+	StateLeafKey hexutil.Bytes `json:"stateLeafKey"`
+	LeafKey      hexutil.Bytes `json:"leafKey"`
+	CID          string        `json:"cid"`
+	Removed      bool          `json:"removed"`
+	Value        hexutil.Bytes `json:"value,omitempty"`
+}
+
+// IPLD is the payload of an ipld record
+type IPLD struct {
+	CID  string        `json:"cid"`
+	Data hexutil.Bytes `json:"data"`
+}
@@ -0,0 +1,65 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fields set on the log lines of block processing, so that progress can be followed from the fields
+// rather than the message text
+const (
+	fieldEvent    = "event"
+	fieldBlock    = "block"
+	fieldHash     = "hash"
+	fieldJob      = "job"
+	fieldWorker   = "worker"
+	fieldPriority = "priority"
+	fieldStart    = "start"
+	fieldStop     = "stop"
+	fieldDuration = "duration"
+)
+
+// Values of the event field
+const (
+	eventRangeQueued   = "range_queued"
+	eventRangeAborted  = "range_aborted"
+	eventRangeFinished = "range_finished"
+	eventBatchStarted  = "batch_started"
+	eventBatchFinished = "batch_finished"
+	eventBlockStarted  = "block_started"
+	eventBlockSkipped  = "block_skipped"
+	eventBlockWritten  = "block_written"
+	eventBlockFailed   = "block_failed"
+	eventSlowBlock     = "slow_block"
+)
+
+type loggerKey struct{}
+
+// withLogFields returns a context whose logger adds the fields to those already set in ctx
+func withLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger(ctx).WithFields(fields))
+}
+
+// logger returns a logger with the fields set in ctx, which also carries ctx for the trace IDs
+func logger(ctx context.Context) *logrus.Entry {
+	if entry, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return entry.WithContext(ctx)
+	}
+	return logrus.WithContext(ctx)
+}
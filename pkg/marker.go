@@ -0,0 +1,112 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// CompletionMarker records which blocks have been fully written to the indexer
+type CompletionMarker interface {
+	IsComplete(ctx context.Context, number uint64, hash common.Hash) (bool, error)
+	MarkComplete(number uint64, hash common.Hash) error
+	Close() error
+}
+
+// Queryer runs queries against the indexed database
+type Queryer interface {
+	Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// hasHeaderPgStr checks for the header of a block, which is inserted in the same transaction as the rest
+// of the block's data
+const hasHeaderPgStr = `SELECT EXISTS (SELECT 1 FROM eth.header_cids WHERE block_number = $1 AND block_hash = $2)`
+
+// DBMarker is a CompletionMarker for Postgres output, which looks blocks up in the indexed database itself.
+// It stays consistent with the database across resets and restores, and can be shared by several
+// instances writing to the same database.
+type DBMarker struct {
+	db Queryer
+}
+
+// NewDBMarker creates a DBMarker for the indexed database
+func NewDBMarker(db Queryer) *DBMarker {
+	return &DBMarker{db: db}
+}
+
+// IsComplete returns whether the block's header has been committed
+func (dm *DBMarker) IsComplete(ctx context.Context, number uint64, hash common.Hash) (bool, error) {
+	var exists bool
+	if err := dm.db.Get(ctx, &exists, hasHeaderPgStr, int64(number), hash.Hex()); err != nil {
+		return false, fmt.Errorf("error checking for block %d %s: %w", number, hash, err)
+	}
+	return exists, nil
+}
+
+// MarkComplete does nothing, as the committed block is its own record
+func (dm *DBMarker) MarkComplete(uint64, common.Hash) error {
+	return nil
+}
+
+// Close does nothing, the database belongs to the indexer
+func (dm *DBMarker) Close() error {
+	return nil
+}
+
+// LogMarker is a CompletionMarker for outputs other than Postgres, backed by a LevelDB database keyed by
+// block number and hash. Blocks are looked up on disk rather than held in memory, and each one is synced
+// to disk once recorded.
+type LogMarker struct {
+	db *leveldb.DB
+}
+
+// NewLogMarker opens (or creates) the completion log database in the directory at path
+func NewLogMarker(path string) (*LogMarker, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening completion log %s: %w", path, err)
+	}
+	return &LogMarker{db: db}, nil
+}
+
+// markerKey is the big-endian block number followed by the block hash
+func markerKey(number uint64, hash common.Hash) []byte {
+	key := make([]byte, 8+common.HashLength)
+	binary.BigEndian.PutUint64(key, number)
+	copy(key[8:], hash.Bytes())
+	return key
+}
+
+// IsComplete returns whether the block was recorded as complete
+func (lm *LogMarker) IsComplete(_ context.Context, number uint64, hash common.Hash) (bool, error) {
+	return lm.db.Has(markerKey(number, hash), nil)
+}
+
+// MarkComplete records the block as complete, syncing the record to disk
+func (lm *LogMarker) MarkComplete(number uint64, hash common.Hash) error {
+	return lm.db.Put(markerKey(number, hash), nil, &opt.WriteOptions{Sync: true})
+}
+
+// Close closes the completion log database
+func (lm *LogMarker) Close() error {
+	return lm.db.Close()
+}
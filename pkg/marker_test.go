@@ -0,0 +1,117 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func TestLogMarker(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "completion")
+	hash := common.HexToHash("0x01")
+	other := common.HexToHash("0x02")
+
+	marker, err := NewLogMarker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete, err := marker.IsComplete(ctx, 5, hash); err != nil || complete {
+		t.Fatalf("expected block 5 not to be complete, got %v, %v", complete, err)
+	}
+	if err := marker.MarkComplete(5, hash); err != nil {
+		t.Fatal(err)
+	}
+	// marking a block again is harmless
+	if err := marker.MarkComplete(5, hash); err != nil {
+		t.Fatal(err)
+	}
+	if err := marker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	marker, err = NewLogMarker(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer marker.Close()
+	for _, c := range []struct {
+		number   uint64
+		hash     common.Hash
+		complete bool
+	}{
+		{5, hash, true},
+		// another block at the same height, e.g. after a reorg
+		{5, other, false},
+		{6, hash, false},
+	} {
+		complete, err := marker.IsComplete(ctx, c.number, c.hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if complete != c.complete {
+			t.Errorf("block %d %s: expected complete=%v after reopening", c.number, c.hash, c.complete)
+		}
+	}
+}
+
+// headerQueryer answers the header lookup of a DBMarker from a set of committed headers
+type headerQueryer struct {
+	headers map[int64]string
+	err     error
+}
+
+func (q headerQueryer) Get(_ context.Context, dest interface{}, query string, args ...interface{}) error {
+	if q.err != nil {
+		return q.err
+	}
+	if query != hasHeaderPgStr || len(args) != 2 {
+		return errors.New("unexpected query")
+	}
+	number, hash := args[0].(int64), args[1].(string)
+	*dest.(*bool) = q.headers[number] == hash
+	return nil
+}
+
+func TestDBMarker(t *testing.T) {
+	ctx := context.Background()
+	hash := common.HexToHash("0x01")
+	marker := NewDBMarker(headerQueryer{headers: map[int64]string{5: hash.Hex()}})
+
+	if complete, err := marker.IsComplete(ctx, 5, hash); err != nil || !complete {
+		t.Errorf("expected block 5 to be complete, got %v, %v", complete, err)
+	}
+	if complete, err := marker.IsComplete(ctx, 5, common.HexToHash("0x02")); err != nil || complete {
+		t.Errorf("expected another block at height 5 not to be complete, got %v, %v", complete, err)
+	}
+	if complete, err := marker.IsComplete(ctx, 6, hash); err != nil || complete {
+		t.Errorf("expected block 6 not to be complete, got %v, %v", complete, err)
+	}
+	// the committed header is the record
+	if err := marker.MarkComplete(6, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := NewDBMarker(headerQueryer{err: errors.New("connection refused")})
+	if _, err := failing.IsComplete(ctx, 5, hash); err == nil {
+		t.Error("expected the database error")
+	}
+}
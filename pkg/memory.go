@@ -0,0 +1,197 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+const (
+	// estimate used for blocks before any block has been observed
+	defaultBlockMemory    = 64 << 20
+	defaultMemoryOverhead = 4
+	// weight of the latest block in the moving average of bytes written per gas
+	memoryEstimateWeight = 0.1
+
+	cgroupV2MemoryMax = "/sys/fs/cgroup/memory.max"
+	cgroupV1MemoryMax = "/sys/fs/cgroup/memory/memory.limit_in_bytes"
+)
+
+// MemoryConfig configures the memory budget for blocks in processing
+type MemoryConfig struct {
+	// Budget in bytes for the estimated memory of all blocks in processing; disabled if zero
+	Budget uint64
+	// Multiplier from the bytes written for a block to its estimated peak memory
+	Overhead float64
+}
+
+// CgroupMemoryLimit returns the memory limit of the process's cgroup, or zero if there is none
+func CgroupMemoryLimit() (uint64, error) {
+	for _, path := range []string{cgroupV2MemoryMax, cgroupV1MemoryMax} {
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		data = bytes.TrimSpace(data)
+		if string(data) == "max" {
+			return 0, nil
+		}
+		limit, err := strconv.ParseUint(string(data), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid memory limit in %s: %w", path, err)
+		}
+		// cgroup v1 reports a huge page-aligned number when unlimited
+		if limit >= 1<<62 {
+			return 0, nil
+		}
+		return limit, nil
+	}
+	return 0, nil
+}
+
+// memoryGovernor admits blocks into processing only while the sum of their estimated peak memory
+// stays within the budget. A block is always admitted when nothing else is in processing.
+//
+// The peak memory of a block is estimated as Overhead times the bytes written for it, since the
+// indexer buffers a block's IPLDs until it is committed. Before a block is diffed this is
+// predicted from its gas used, using a moving average of bytes written per gas; once diffed, its
+// reservation is corrected to the observed size until it is committed.
+//
+// A nil governor does not limit anything.
+type memoryGovernor struct {
+	MemoryConfig
+
+	mtx         sync.Mutex
+	reserved    uint64
+	active      int
+	bytesPerGas float64
+	wake        chan struct{}
+}
+
+func newMemoryGovernor(conf MemoryConfig) *memoryGovernor {
+	if conf.Budget == 0 {
+		return nil
+	}
+	if conf.Overhead <= 0 {
+		conf.Overhead = defaultMemoryOverhead
+	}
+	prom.SetMemoryBudget(conf.Budget)
+	return &memoryGovernor{
+		MemoryConfig: conf,
+		wake:         make(chan struct{}),
+	}
+}
+
+// estimate predicts the peak memory needed to process the block
+func (m *memoryGovernor) estimate(block *types.Block) uint64 {
+	if m == nil {
+		return 0
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.bytesPerGas == 0 {
+		return defaultBlockMemory
+	}
+	return uint64(m.Overhead * (float64(block.Size()) + m.bytesPerGas*float64(block.GasUsed())))
+}
+
+// reserve waits until the estimated memory fits in the budget, returning false if stop was closed first.
+// Every successful reserve must be followed by a release of the same amount.
+func (m *memoryGovernor) reserve(n uint64, stop <-chan struct{}) bool {
+	if m == nil {
+		return true
+	}
+	m.mtx.Lock()
+	for m.active > 0 && m.reserved+n > m.Budget {
+		wake := m.wake
+		m.mtx.Unlock()
+		select {
+		case <-wake:
+		case <-stop:
+			return false
+		}
+		m.mtx.Lock()
+	}
+	m.active++
+	m.reserved += n
+	prom.SetMemoryReserved(m.reserved)
+	m.mtx.Unlock()
+	return true
+}
+
+// observe records the bytes written for a diffed block, replaces its reservation by the observed
+// estimate and returns it
+func (m *memoryGovernor) observe(block *types.Block, size, reserved uint64) uint64 {
+	if m == nil {
+		return 0
+	}
+	observed := uint64(m.Overhead * float64(size))
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if gas := block.GasUsed(); gas > 0 && size > block.Size() {
+		perGas := float64(size-block.Size()) / float64(gas)
+		if m.bytesPerGas == 0 {
+			m.bytesPerGas = perGas
+		} else {
+			m.bytesPerGas += memoryEstimateWeight * (perGas - m.bytesPerGas)
+		}
+	}
+	m.reserved = m.reserved - reserved + observed
+	prom.SetMemoryReserved(m.reserved)
+	if observed < reserved {
+		m.signal()
+	}
+
+	log := logrus.WithFields(logrus.Fields{"block": block.NumberU64(), "estimated": reserved, "observed": observed})
+	if observed > m.Budget {
+		log.Warn("Estimated block memory exceeds the memory budget")
+	} else {
+		log.Debug("Estimated block memory")
+	}
+	prom.ObserveBlockMemory(observed)
+	return observed
+}
+
+// release frees a reservation
+func (m *memoryGovernor) release(n uint64) {
+	if m == nil {
+		return
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.active--
+	m.reserved -= n
+	prom.SetMemoryReserved(m.reserved)
+	m.signal()
+}
+
+// signal wakes up all waiting reservations; the mutex must be held
+func (m *memoryGovernor) signal() {
+	close(m.wake)
+	m.wake = make(chan struct{})
+}
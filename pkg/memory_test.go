@@ -0,0 +1,148 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// reserveAsync reserves memory in the background, reporting whether it was admitted
+func reserveAsync(m *memoryGovernor, n uint64, stop <-chan struct{}) <-chan bool {
+	done := make(chan bool, 1)
+	go func() { done <- m.reserve(n, stop) }()
+	return done
+}
+
+func assertWaiting(t *testing.T, done <-chan bool) {
+	t.Helper()
+	select {
+	case <-done:
+		t.Fatal("expected the reservation to wait")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func assertAdmitted(t *testing.T, done <-chan bool) {
+	t.Helper()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatal("expected the reservation to be admitted")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the reservation")
+	}
+}
+
+func assertReserved(t *testing.T, m *memoryGovernor, active int, reserved uint64) {
+	t.Helper()
+	if m.active != active || m.reserved != reserved {
+		t.Fatalf("expected %d blocks with %d bytes reserved, got %d blocks with %d bytes", active, reserved, m.active, m.reserved)
+	}
+}
+
+func TestMemoryDisabled(t *testing.T) {
+	m := newMemoryGovernor(MemoryConfig{})
+	if m != nil {
+		t.Fatal("expected no governor without a budget")
+	}
+	// a nil governor limits nothing
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	if m.estimate(block) != 0 || !m.reserve(1<<40, nil) || m.observe(block, 1<<30, 0) != 0 {
+		t.Fatal("expected a nil governor to admit every block")
+	}
+	m.release(1 << 40)
+}
+
+func TestMemoryReserve(t *testing.T) {
+	m := newMemoryGovernor(MemoryConfig{Budget: 100})
+	if !m.reserve(60, nil) {
+		t.Fatal("expected a block within the budget to be admitted")
+	}
+	done := reserveAsync(m, 60, nil)
+	assertWaiting(t, done)
+	m.release(60)
+	assertAdmitted(t, done)
+	assertReserved(t, m, 1, 60)
+
+	// a waiting reservation gives up when stopped
+	stop := make(chan struct{})
+	done = reserveAsync(m, 60, stop)
+	assertWaiting(t, done)
+	close(stop)
+	if <-done {
+		t.Fatal("expected a stopped reservation to fail")
+	}
+	m.release(60)
+	assertReserved(t, m, 0, 0)
+}
+
+func TestMemoryOversizeBlock(t *testing.T) {
+	m := newMemoryGovernor(MemoryConfig{Budget: 100})
+	// a block over the budget is admitted on its own, so it can't stall processing...
+	if !m.reserve(1000, nil) {
+		t.Fatal("expected a lone oversize block to be admitted")
+	}
+	// ...but nothing else is admitted next to it
+	done := reserveAsync(m, 1, nil)
+	assertWaiting(t, done)
+	m.release(1000)
+	assertAdmitted(t, done)
+	m.release(1)
+	assertReserved(t, m, 0, 0)
+}
+
+func TestMemoryObserve(t *testing.T) {
+	m := newMemoryGovernor(MemoryConfig{Budget: 1 << 30, Overhead: 2})
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1), GasUsed: 1000})
+	if est := m.estimate(block); est != defaultBlockMemory {
+		t.Fatalf("expected the default estimate before any block was observed, got %d", est)
+	}
+	if !m.reserve(defaultBlockMemory, nil) {
+		t.Fatal("expected the block to be admitted")
+	}
+	// two bytes written per gas
+	size := block.Size() + 2000
+	observed := m.observe(block, size, defaultBlockMemory)
+	if observed != 2*size {
+		t.Fatalf("expected the observed estimate to be %d, got %d", 2*size, observed)
+	}
+	assertReserved(t, m, 1, observed)
+	m.release(observed)
+	assertReserved(t, m, 0, 0)
+
+	// later blocks are predicted from their gas used
+	next := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(2), GasUsed: 5000})
+	if est, expected := m.estimate(next), 2*(next.Size()+10000); est != expected {
+		t.Fatalf("expected the estimate to be %d, got %d", expected, est)
+	}
+}
+
+func TestMemoryObserveWakes(t *testing.T) {
+	m := newMemoryGovernor(MemoryConfig{Budget: 100, Overhead: 1})
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(1)})
+	m.reserve(90, nil)
+	done := reserveAsync(m, 50, nil)
+	assertWaiting(t, done)
+	// the diffed block turns out smaller than reserved, making room for the waiting one
+	m.observe(block, 40, 90)
+	assertAdmitted(t, done)
+	assertReserved(t, m, 2, 90)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/ethereum/go-ethereum/common"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/car"
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
+)
+
+// rangeOutput holds the output state shared by the blocks of a range: the CAR file, if enabled.
+// It is shared by the diff and commit stages of a range; the CAR writer synchronizes their access.
+type rangeOutput struct {
+	sds *Service
+	car *car.Writer
+}
+
+// pendingBlock is a diffed block whose indexer transaction has not been committed yet.
+// It holds a transaction slot until it is committed or rolled back.
+type pendingBlock struct {
+	// context carrying the block's span
+	ctx    context.Context
+	tx     interfaces.Batch
+	number uint64
+	hash   common.Hash
+	// CAR sections of the block, if CAR output is enabled
+	car *car.Block
+	// approximate number of bytes written to the transaction
+	size   uint64
+	timing BlockTiming
+}
+
+// newRangeOutput creates the output state for the block range
+func (sds *Service) newRangeOutput(start, stop uint64) (*rangeOutput, error) {
+	out := &rangeOutput{sds: sds}
+	if sds.carDir != "" {
+		path := filepath.Join(sds.carDir, fmt.Sprintf("%d-%d.car", start, stop))
+		w, err := car.NewWriter(path, sds.carVersion, sds.carOverwrite)
+		if err != nil {
+			return nil, err
+		}
+		out.car = w
+	}
+	return out, nil
+}
+
+// commit commits the block's transaction; the CAR root and completion marker are
+// only recorded once the commit succeeded
+func (out *rangeOutput) commit(b pendingBlock) error {
+	t := time.Now()
+	_, span := tracing.Start(b.ctx, "Submit")
+	err := b.tx.Submit()
+	tracing.End(span, err)
+	prom.SetLastProcessedHeight(int64(b.number))
+	prom.SetTimeMetric(prom.T_POSTGRES_TX_COMMIT, time.Now().Sub(t))
+	out.sds.throttle.observeCommit(time.Since(t))
+	if err != nil {
+		out.rollback(b, err)
+		return wrapError(ErrIndexerWrite, err)
+	}
+	out.sds.txSlots.release()
+	b.timing.Commit = time.Since(t)
+	b.timing.DiffStats.observe()
+	out.sds.timings.record(b.ctx, b.timing)
+	if out.car != nil {
+		if err := out.car.Commit(b.car); err != nil {
+			return err
+		}
+	}
+	if out.sds.marker != nil {
+		return out.sds.marker.MarkComplete(b.number, b.hash)
+	}
+	return nil
+}
+
+// rollback rolls back the block's transaction
+func (out *rangeOutput) rollback(b pendingBlock, err error) {
+	b.tx.RollbackOnFailure(err)
+	out.sds.txSlots.release()
+}
+
+// close finalizes the CAR file.
+// It returns err, or else the error encountered while closing.
+func (out *rangeOutput) close(err error) error {
+	if out.car != nil {
+		if closeErr := out.car.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// txSlots limits the number of open indexer transactions, each of which holds a database connection.
+// A nil txSlots does not limit anything.
+type txSlots chan struct{}
+
+func newTxSlots(n uint) txSlots {
+	if n == 0 {
+		return nil
+	}
+	return make(txSlots, n)
+}
+
+// acquire waits for a free slot, returning an error if ctx is done or quit is closed first.
+// Every successful acquire must be followed by a release.
+func (s txSlots) acquire(ctx context.Context, quit <-chan struct{}) error {
+	if s == nil {
+		return nil
+	}
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-quit:
+		return errPipelineStopped
+	}
+}
+
+// release frees a slot
+func (s txSlots) release() {
+	if s != nil {
+		<-s
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
+)
+
+// Pipeline stages; a range is processed with one goroutine per stage, connected by bounded queues,
+// so that loading block N+1 and committing block N-1 overlap with diffing block N.
+const (
+	stageLoad   = "load"
+	stageDiff   = "diff"
+	stageCommit = "commit"
+)
+
+const defaultPipelineDepth = 2
+
+var errPipelineStopped = errors.New("range processing was stopped")
+
+// rangeResult summarizes the processing of a range
+type rangeResult struct {
+	processed, skipped, failed uint64
+	failedHeights              []uint64
+	// last block that was committed or skipped
+	last uint64
+	// whether processing was interrupted by the quit signal
+	quit bool
+	// error which stopped processing
+	err error
+}
+
+// stageItem is passed between the pipeline stages
+type stageItem struct {
+	number uint64
+	// span of the block, ended once it has been committed or dropped, and a context carrying it
+	ctx     context.Context
+	span    trace.Span
+	started time.Time
+	loaded  *loadedBlock
+	pending *pendingBlock
+	// memory reserved for the block
+	mem     uint64
+	skipped bool
+	err     error
+}
+
+// processRange processes the blocks of the range in order through the load, diff and commit stages,
+// writing them to out.
+// Loading stops early when quit is closed; blocks already loaded are still diffed and committed.
+// Written and failed blocks are reported to progress, and each block is traced in a span under the one in ctx.
+// handleErr is called for every block that failed; if it returns false processing of the range stops.
+func (sds *Service) processRange(ctx context.Context, rng RangeRequest, out *rangeOutput, quit <-chan struct{}, progress *workerProgress, handleErr func(uint64, error) bool) (res rangeResult) {
+	params := rng.Params
+	// compute leaf paths of watched addresses in the params
+	params.ComputeWatchedAddressesLeafPaths()
+
+	stop := make(chan struct{})
+	loaded := make(chan *stageItem, sds.pipelineDepth)
+	diffed := make(chan *stageItem, sds.pipelineDepth)
+
+	// prefetch the trie nodes of loaded blocks while the blocks before them are diffed
+	var diffing atomic.Uint64
+	var prefetch chan *loadedBlock
+	var prefetchWg sync.WaitGroup
+	if sds.prefetchNodes > 0 {
+		prefetch = make(chan *loadedBlock, sds.pipelineDepth)
+		prefetchWg.Add(1)
+		go func() {
+			defer prefetchWg.Done()
+			for lb := range prefetch {
+				sds.prefetchState(lb, sds.prefetchNodes, &diffing)
+			}
+		}()
+		defer prefetchWg.Wait()
+	}
+
+	// load stage
+	go func() {
+		defer close(loaded)
+		if prefetch != nil {
+			defer close(prefetch)
+		}
+		for height := rng.Start; height <= rng.Stop; height++ {
+			select {
+			case <-quit:
+				return
+			case <-stop:
+				return
+			default:
+			}
+			t := time.Now()
+			item := &stageItem{number: height, started: t}
+			item.ctx, item.span = tracing.Start(ctx, "block", attribute.Int64("block.number", int64(height)))
+			item.ctx = withLogFields(item.ctx, logrus.Fields{fieldBlock: height})
+			item.skipped, item.err = sds.checkSkip(item.ctx, height, rng.RangeOptions)
+			if !item.skipped && item.err == nil {
+				item.loaded, item.err = sds.loadBlockAt(item.ctx, height, params)
+			}
+			if item.loaded != nil {
+				item.ctx = withLogFields(item.ctx, logrus.Fields{fieldHash: item.loaded.block.Hash()})
+			}
+			if item.loaded != nil && prefetch != nil {
+				// skip prefetching rather than hold up loading
+				select {
+				case prefetch <- item.loaded:
+				default:
+				}
+			}
+			prom.AddStageBusyTime(stageLoad, time.Since(t))
+			if !sendStageItem(stageDiff, loaded, item, stop) {
+				item.end(errPipelineStopped)
+				return
+			}
+		}
+	}()
+
+	// diff stage
+	go func() {
+		defer close(diffed)
+		stopped := false
+		for item := range loaded {
+			prom.DecStageQueueLength(stageDiff)
+			if stopped {
+				item.end(errPipelineStopped)
+				continue
+			}
+			if item.loaded != nil {
+				// blocks hold a memory reservation and a throttle slot from the start of the diff
+				// until they are committed
+				if !sds.admitBlock(item, stop) {
+					item.end(errPipelineStopped)
+					stopped = true
+					continue
+				}
+				diffing.Store(item.number)
+				t := time.Now()
+				var pending pendingBlock
+				pending, item.err = sds.diffBlock(item.ctx, item.loaded, out)
+				if item.err == nil {
+					item.pending = &pending
+					item.mem = sds.memory.observe(item.loaded.block, pending.size, item.mem)
+				} else {
+					sds.releaseBlock(item)
+				}
+				item.loaded = nil
+				prom.AddStageBusyTime(stageDiff, time.Since(t))
+			}
+			if !sendStageItem(stageCommit, diffed, item, stop) {
+				if item.pending != nil {
+					out.rollback(*item.pending, errPipelineStopped)
+					sds.releaseBlock(item)
+				}
+				item.end(errPipelineStopped)
+				stopped = true
+			}
+		}
+	}()
+
+	// commit stage
+	stopped := false
+	for item := range diffed {
+		prom.DecStageQueueLength(stageCommit)
+		if stopped {
+			if item.pending != nil {
+				out.rollback(*item.pending, errPipelineStopped)
+				sds.releaseBlock(item)
+			}
+			item.end(errPipelineStopped)
+			continue
+		}
+		if item.pending != nil {
+			// the block is only counted as written, and its reservation and throttle slot only
+			// returned, once its commit has finished
+			t := time.Now()
+			item.err = out.commit(*item.pending)
+			sds.releaseBlock(item)
+			prom.AddStageBusyTime(stageCommit, time.Since(t))
+		}
+		item.end(item.err)
+		if errors.Is(item.err, errPipelineStopped) {
+			// blocks dropped because the service is stopping are neither written nor failed
+			continue
+		}
+		if item.err != nil {
+			res.failed++
+			res.failedHeights = append(res.failedHeights, item.number)
+			progress.blockFailed(item.number)
+			if !handleErr(item.number, item.err) {
+				res.err = fmt.Errorf("error writing statediff at height %d in range (%d, %d): %w", item.number, rng.Start, rng.Stop, item.err)
+				close(stop)
+				stopped = true
+			}
+			continue
+		}
+		res.last = item.number
+		if item.skipped {
+			res.skipped++
+			progress.blockSkipped(item.number)
+			continue
+		}
+		res.processed++
+		progress.blockWritten(item.pending)
+		timing := item.pending.timing
+		logger(item.ctx).WithFields(logrus.Fields{
+			fieldEvent:     eventBlockWritten,
+			fieldDuration:  time.Since(item.started),
+			"stateNodes":   timing.StateNodes,
+			"storageNodes": timing.StorageNodes,
+			"removedNodes": timing.RemovedNodes,
+			"iplds":        timing.IPLDs,
+			"codes":        timing.Codes,
+			"bytes":        timing.Bytes,
+		}).Infof("Finished processing block %d", item.number)
+	}
+	select {
+	case <-quit:
+		res.quit = true
+	default:
+	}
+	return res
+}
+
+// end ends the block's span
+func (item *stageItem) end(err error) {
+	if item.skipped {
+		item.span.SetAttributes(attribute.Bool("block.skipped", true))
+	}
+	tracing.End(item.span, err)
+}
+
+// admitBlock waits for memory and a throttle slot for the loaded block, returning false if stop was closed first
+func (sds *Service) admitBlock(item *stageItem, stop <-chan struct{}) bool {
+	item.mem = sds.memory.estimate(item.loaded.block)
+	if !sds.memory.reserve(item.mem, stop) {
+		return false
+	}
+	if !sds.throttle.acquire(stop) {
+		sds.memory.release(item.mem)
+		return false
+	}
+	return true
+}
+
+// releaseBlock returns the memory reservation and throttle slot held by the block
+func (sds *Service) releaseBlock(item *stageItem) {
+	sds.throttle.release()
+	sds.memory.release(item.mem)
+}
+
+// sendStageItem passes an item to the next stage, returning false if the pipeline was stopped first
+func sendStageItem(stage string, ch chan<- *stageItem, item *stageItem, stop <-chan struct{}) bool {
+	t := time.Now()
+	defer func() { prom.AddStageBlockedTime(stage, time.Since(t)) }()
+	select {
+	case ch <- item:
+		prom.IncStageQueueLength(stage)
+		return true
+	case <-stop:
+		return false
+	}
+}
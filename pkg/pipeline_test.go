@@ -0,0 +1,254 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	sdtypes "github.com/cerc-io/plugeth-statediff/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newTestReader returns a reader over a chain of empty blocks up to the given height
+func newTestReader(height uint64) *LvlDBReader {
+	db := rawdb.NewMemoryDatabase()
+	var parent common.Hash
+	for number := uint64(0); number <= height; number++ {
+		block := types.NewBlockWithHeader(&types.Header{
+			ParentHash: parent,
+			Number:     new(big.Int).SetUint64(number),
+			Root:       types.EmptyRootHash,
+			Difficulty: big.NewInt(1),
+		})
+		rawdb.WriteBlock(db, block)
+		rawdb.WriteCanonicalHash(db, block.Hash(), number)
+		rawdb.WriteTd(db, block.Hash(), number, new(big.Int).SetUint64(number+1))
+		rawdb.WriteHeadHeaderHash(db, block.Hash())
+		parent = block.Hash()
+	}
+	return &LvlDBReader{ethDB: db, stateDB: state.NewDatabase(db), chainConfig: params.TestChainConfig}
+}
+
+// testIndexer records the transactions of pushed blocks. Submits wait until hold is closed, and fail for
+// the blocks in failing.
+type testIndexer struct {
+	hold    chan struct{}
+	failing map[uint64]bool
+
+	mtx                           sync.Mutex
+	pushed, committed, rolledBack []uint64
+}
+
+func newTestIndexer() *testIndexer {
+	return &testIndexer{hold: make(chan struct{}), failing: make(map[uint64]bool)}
+}
+
+type testBatch struct {
+	ind    *testIndexer
+	number uint64
+}
+
+func (ind *testIndexer) PushBlock(block *types.Block, _ types.Receipts, _ *big.Int) (interfaces.Batch, error) {
+	ind.mtx.Lock()
+	defer ind.mtx.Unlock()
+	ind.pushed = append(ind.pushed, block.NumberU64())
+	return &testBatch{ind: ind, number: block.NumberU64()}, nil
+}
+
+func (ind *testIndexer) PushStateNode(interfaces.Batch, sdtypes.StateLeafNode, string) error {
+	return nil
+}
+func (ind *testIndexer) PushIPLD(interfaces.Batch, sdtypes.IPLD) error { return nil }
+func (ind *testIndexer) Close() error                                  { return nil }
+
+// numPushed returns the number of blocks pushed so far
+func (ind *testIndexer) numPushed() int {
+	ind.mtx.Lock()
+	defer ind.mtx.Unlock()
+	return len(ind.pushed)
+}
+
+func (b *testBatch) Submit() error {
+	<-b.ind.hold
+	if b.ind.failing[b.number] {
+		return errors.New("commit failed")
+	}
+	b.ind.mtx.Lock()
+	defer b.ind.mtx.Unlock()
+	b.ind.committed = append(b.ind.committed, b.number)
+	return nil
+}
+
+func (b *testBatch) BlockNumber() string { return strconv.FormatUint(b.number, 10) }
+
+func (b *testBatch) RollbackOnFailure(error) {
+	b.ind.mtx.Lock()
+	defer b.ind.mtx.Unlock()
+	b.ind.rolledBack = append(b.ind.rolledBack, b.number)
+}
+
+// waitFor polls until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// runTestRange processes the range in the background, returning the result once hold is closed
+func runTestRange(sds *Service, rng RangeRequest, handleErr func(uint64, error) bool) <-chan rangeResult {
+	progress := newWorkerProgress(1, false)
+	progress.startBatch(&rangeJob{RangeRequest: rng}, rng.Start)
+	done := make(chan rangeResult, 1)
+	go func() {
+		out, _ := sds.newRangeOutput(rng.Start, rng.Stop)
+		done <- sds.processRange(context.Background(), rng, out, sds.quitChan, progress, handleErr)
+	}()
+	return done
+}
+
+// assertReleased checks that no block holds a transaction slot, throttle slot or memory reservation anymore,
+// and that every pushed block was either committed or rolled back
+func assertReleased(t *testing.T, sds *Service, ind *testIndexer) {
+	t.Helper()
+	if n := len(sds.txSlots); n != 0 {
+		t.Errorf("expected all transaction slots to be released, %d held", n)
+	}
+	if n := sds.throttle.active; n != 0 {
+		t.Errorf("expected all throttle slots to be released, %d held", n)
+	}
+	if m := sds.memory; m.active != 0 || m.reserved != 0 {
+		t.Errorf("expected all memory to be released, %d blocks with %d bytes reserved", m.active, m.reserved)
+	}
+	ind.mtx.Lock()
+	defer ind.mtx.Unlock()
+	ended := make(map[uint64]bool)
+	for _, number := range append(append([]uint64{}, ind.committed...), ind.rolledBack...) {
+		ended[number] = true
+	}
+	for _, number := range ind.pushed {
+		if !ended[number] {
+			t.Errorf("block %d was neither committed nor rolled back", number)
+		}
+	}
+}
+
+func newTestPipelineService(ind *testIndexer, height uint64) *Service {
+	return NewStateDiffService(newTestReader(height), ind, ServiceConfig{
+		ServiceWorkers: 1,
+		PipelineDepth:  2,
+		MaxOpenTxs:     3,
+		Throttle:       ThrottleConfig{TargetLatency: time.Hour},
+		Memory:         MemoryConfig{Budget: 1 << 40},
+	})
+}
+
+func TestPipelineStop(t *testing.T) {
+	ind := newTestIndexer()
+	sds := newTestPipelineService(ind, 20)
+	failed := false
+	done := runTestRange(sds, RangeRequest{Start: 1, Stop: 20}, func(uint64, error) bool {
+		failed = true
+		return true
+	})
+	// the first commit is held, while the following blocks take up the remaining transaction slots
+	waitFor(t, "the transaction slots to be taken", func() bool { return len(sds.txSlots) == 3 })
+	sds.Stop()
+	close(ind.hold)
+	res := <-done
+
+	if !res.quit || res.err != nil {
+		t.Fatalf("expected processing to be interrupted without error, got quit %v and error %v", res.quit, res.err)
+	}
+	// blocks dropped on stop are not failures
+	if failed || res.failed != 0 {
+		t.Errorf("expected no failed blocks, got %d", res.failed)
+	}
+	if res.processed < 3 || res.processed == 20 {
+		t.Errorf("expected the blocks in the pipeline to be committed before it stopped, got %d", res.processed)
+	}
+	if int(res.processed) != len(ind.committed) {
+		t.Errorf("expected %d processed blocks to be committed, got %d", res.processed, len(ind.committed))
+	}
+	assertReleased(t, sds, ind)
+}
+
+func TestPipelineFailure(t *testing.T) {
+	ind := newTestIndexer()
+	ind.failing[2] = true
+	sds := newTestPipelineService(ind, 20)
+	var failedBlocks []uint64
+	done := runTestRange(sds, RangeRequest{Start: 1, Stop: 20}, func(number uint64, err error) bool {
+		failedBlocks = append(failedBlocks, number)
+		return false
+	})
+	waitFor(t, "the transaction slots to be taken", func() bool { return len(sds.txSlots) == 3 })
+	close(ind.hold)
+	res := <-done
+
+	if res.err == nil || res.quit {
+		t.Fatalf("expected processing to stop with an error, got quit %v and error %v", res.quit, res.err)
+	}
+	if res.processed != 1 || res.failed != 1 || len(failedBlocks) != 1 || failedBlocks[0] != 2 {
+		t.Errorf("expected block 1 to be written and block 2 to fail, got %d processed and failed blocks %v", res.processed, failedBlocks)
+	}
+	// the blocks diffed after the failed one are rolled back
+	if len(ind.rolledBack) < 2 {
+		t.Errorf("expected the failed block and the pending blocks after it to be rolled back, got %v", ind.rolledBack)
+	}
+	assertReleased(t, sds, ind)
+}
+
+func TestPipelineThrottleLimit(t *testing.T) {
+	conf := ServiceConfig{ServiceWorkers: 2, PipelineDepth: 2, Throttle: ThrottleConfig{TargetLatency: time.Hour}}
+	if limit := newTestService(conf).throttle.limit; limit != 8 {
+		t.Errorf("expected the throttle limit to be the number of blocks the pipelines hold, got %d", limit)
+	}
+	conf.MaxOpenTxs = 3
+	if limit := newTestService(conf).throttle.limit; limit != 3 {
+		t.Errorf("expected the throttle limit to be the number of transaction slots, got %d", limit)
+	}
+}
+
+func TestWriteBlockReleased(t *testing.T) {
+	ind := newTestIndexer()
+	close(ind.hold)
+	sds := newTestPipelineService(ind, 2)
+	if err := sds.WriteStateDiffAt(1, statediff.Params{}); err != nil {
+		t.Fatal(err)
+	}
+	ind.failing[2] = true
+	if err := sds.WriteStateDiffAt(2, statediff.Params{}); err == nil {
+		t.Fatal("expected the failed commit to be returned")
+	}
+	assertReleased(t, sds, ind)
+}
@@ -0,0 +1,160 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+// Outcomes of prefetching a block
+const (
+	prefetchComplete = "complete"
+	prefetchLimited  = "limited"
+	prefetchLate     = "late"
+	// the state tries of the block could not be opened
+	prefetchUnavailable = "unavailable"
+)
+
+// prefetchState warms the trie cache for an upcoming block, by walking the difference between
+// the parent's and the block's state tries, and between the storage tries of the changed accounts,
+// as the diff of the block will. It stops after maxNodes nodes, or once the block (or a later one)
+// has started being diffed, which is tracked by diffing.
+func (sds *Service) prefetchState(lb *loadedBlock, maxNodes uint, diffing *atomic.Uint64) {
+	p := &statePrefetch{
+		db:      sds.lvlDBReader.StateDB(),
+		number:  lb.block.NumberU64(),
+		budget:  maxNodes,
+		diffing: diffing,
+	}
+	result := p.walkState(lb.parentRoot, lb.block.Root())
+	prom.AddPrefetchedNodes(maxNodes - p.budget)
+	prom.IncPrefetchedBlocks(result)
+	log := logrus.WithFields(logrus.Fields{"block": p.number, "nodes": maxNodes - p.budget})
+	if p.err != nil {
+		log = log.WithError(p.err)
+	}
+	log.Debugf("Prefetch %s", result)
+}
+
+// statePrefetch is the state of a single block's prefetch
+type statePrefetch struct {
+	db      state.Database
+	number  uint64
+	budget  uint
+	diffing *atomic.Uint64
+	// error which made the state unavailable
+	err error
+}
+
+func (p *statePrefetch) walkState(oldRoot, newRoot common.Hash) string {
+	oldTrie, err := p.db.OpenTrie(oldRoot)
+	if err != nil {
+		p.err = err
+		return prefetchUnavailable
+	}
+	newTrie, err := p.db.OpenTrie(newRoot)
+	if err != nil {
+		p.err = err
+		return prefetchUnavailable
+	}
+	it, _ := trie.NewDifferenceIterator(oldTrie.NodeIterator(nil), newTrie.NodeIterator(nil))
+	for it.Next(true) {
+		if result := p.visit(); result != "" {
+			return result
+		}
+		if !it.Leaf() {
+			continue
+		}
+		var account types.StateAccount
+		if err := rlp.DecodeBytes(it.LeafBlob(), &account); err != nil {
+			continue
+		}
+		oldStorageRoot := types.EmptyRootHash
+		oldIt := trie.NewIterator(oldTrie.NodeIterator(it.LeafKey()))
+		if oldIt.Next() && bytes.Equal(oldIt.Key, it.LeafKey()) {
+			var oldAccount types.StateAccount
+			if err := rlp.DecodeBytes(oldIt.Value, &oldAccount); err == nil {
+				oldStorageRoot = oldAccount.Root
+			}
+		}
+		if account.Root == oldStorageRoot {
+			continue
+		}
+		addrHash := common.BytesToHash(it.LeafKey())
+		if result := p.walkStorage(oldRoot, newRoot, addrHash, oldStorageRoot, account.Root); result != "" {
+			return result
+		}
+	}
+	return prefetchComplete
+}
+
+func (p *statePrefetch) walkStorage(oldStateRoot, newStateRoot, addrHash, oldRoot, newRoot common.Hash) string {
+	oldTrie, err := p.db.OpenStorageTrie(oldStateRoot, addrHash, oldRoot)
+	if err != nil {
+		return ""
+	}
+	newTrie, err := p.db.OpenStorageTrie(newStateRoot, addrHash, newRoot)
+	if err != nil {
+		return ""
+	}
+	it, _ := trie.NewDifferenceIterator(oldTrie.NodeIterator(nil), newTrie.NodeIterator(nil))
+	for it.Next(true) {
+		if result := p.visit(); result != "" {
+			return result
+		}
+	}
+	return ""
+}
+
+// visit accounts for a resolved node, returning the outcome if the prefetch should stop
+func (p *statePrefetch) visit() string {
+	if p.diffing.Load() >= p.number {
+		return prefetchLate
+	}
+	if p.budget == 0 {
+		return prefetchLimited
+	}
+	p.budget--
+	return ""
+}
+
+// nodeReadCounter counts and times reads of trie nodes which reach the database, i.e. which missed
+// the trie clean cache. With the hash-based scheme nodes are keyed by their 32 byte hash. It only
+// backs the trie database, as legacy contract code is keyed by its hash as well.
+type nodeReadCounter struct {
+	ethdb.Database
+}
+
+func (db nodeReadCounter) Get(key []byte) (value []byte, err error) {
+	if len(key) != common.HashLength {
+		return db.Database.Get(key)
+	}
+	prom.IncTrieNodeReads()
+	defer observeRead(readTrieNode, time.Now(), &err)
+	return db.Database.Get(key)
+}
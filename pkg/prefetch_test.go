@@ -0,0 +1,168 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"math/big"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+const prefetchTestBlock = 10
+
+var prefetchTestContract = common.HexToAddress("0xc0")
+
+func prefetchTestAccount(i int) common.Address {
+	return common.BigToAddress(big.NewInt(int64(1000 + i)))
+}
+
+// commitState applies the changes to the state at root and commits the result
+func commitState(t *testing.T, db state.Database, root common.Hash, change func(*state.StateDB)) common.Hash {
+	sdb, err := state.New(root, db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	change(sdb)
+	root, err = sdb.Commit(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.TrieDB().Commit(root, false); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// prefetchTestStates returns the parent state and the states after changing balances only, and after
+// also changing contract storage
+func prefetchTestStates(t *testing.T) (db state.Database, parent, balances, storage common.Hash) {
+	db = state.NewDatabase(rawdb.NewMemoryDatabase())
+	parent = commitState(t, db, types.EmptyRootHash, func(sdb *state.StateDB) {
+		for i := 0; i < 100; i++ {
+			sdb.SetBalance(prefetchTestAccount(i), big.NewInt(1))
+		}
+		sdb.SetNonce(prefetchTestContract, 1)
+		for i := 0; i < 100; i++ {
+			sdb.SetState(prefetchTestContract, common.BigToHash(big.NewInt(int64(i))), common.HexToHash("0x01"))
+		}
+	})
+	changeBalances := func(sdb *state.StateDB) {
+		for i := 0; i < 100; i += 10 {
+			sdb.SetBalance(prefetchTestAccount(i), big.NewInt(2))
+		}
+	}
+	balances = commitState(t, db, parent, changeBalances)
+	storage = commitState(t, db, parent, func(sdb *state.StateDB) {
+		changeBalances(sdb)
+		for i := 0; i < 100; i += 10 {
+			sdb.SetState(prefetchTestContract, common.BigToHash(big.NewInt(int64(i))), common.HexToHash("0x02"))
+		}
+	})
+	return db, parent, balances, storage
+}
+
+// stateDiffNodes counts the nodes of the difference between the state tries only
+func stateDiffNodes(t *testing.T, db state.Database, oldRoot, newRoot common.Hash) uint {
+	oldTrie, err := db.OpenTrie(oldRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTrie, err := db.OpenTrie(newRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var n uint
+	it, _ := trie.NewDifferenceIterator(oldTrie.NodeIterator(nil), newTrie.NodeIterator(nil))
+	for it.Next(true) {
+		n++
+	}
+	return n
+}
+
+func newTestPrefetch(db state.Database, budget uint, diffing uint64) *statePrefetch {
+	p := &statePrefetch{db: db, number: prefetchTestBlock, budget: budget, diffing: new(atomic.Uint64)}
+	p.diffing.Store(diffing)
+	return p
+}
+
+func TestPrefetchComplete(t *testing.T) {
+	db, parent, balances, storage := prefetchTestStates(t)
+	const budget = 100000
+
+	// with only balances changed, exactly the difference of the state tries is walked
+	p := newTestPrefetch(db, budget, prefetchTestBlock-1)
+	if result := p.walkState(parent, balances); result != prefetchComplete {
+		t.Fatalf("expected the prefetch to complete, got %s", result)
+	}
+	stateNodes := stateDiffNodes(t, db, parent, balances)
+	if visited := budget - p.budget; visited != stateNodes {
+		t.Errorf("expected %d state trie nodes to be visited, got %d", stateNodes, visited)
+	}
+
+	// changed storage tries are walked as well
+	p = newTestPrefetch(db, budget, prefetchTestBlock-1)
+	if result := p.walkState(parent, storage); result != prefetchComplete {
+		t.Fatalf("expected the prefetch to complete, got %s", result)
+	}
+	stateNodes = stateDiffNodes(t, db, parent, storage)
+	if visited := budget - p.budget; visited <= stateNodes {
+		t.Errorf("expected storage trie nodes to be visited beyond the %d state trie nodes, got %d", stateNodes, visited)
+	}
+}
+
+func TestPrefetchLimited(t *testing.T) {
+	db, parent, _, storage := prefetchTestStates(t)
+	p := newTestPrefetch(db, 5, 0)
+	if result := p.walkState(parent, storage); result != prefetchLimited {
+		t.Fatalf("expected the prefetch to be limited, got %s", result)
+	}
+	if p.budget != 0 {
+		t.Errorf("expected the budget to be used up, %d nodes left", p.budget)
+	}
+}
+
+func TestPrefetchLate(t *testing.T) {
+	db, parent, _, storage := prefetchTestStates(t)
+	// the block itself is already being diffed
+	p := newTestPrefetch(db, 100, prefetchTestBlock)
+	if result := p.walkState(parent, storage); result != prefetchLate {
+		t.Fatalf("expected the prefetch to be late, got %s", result)
+	}
+	if p.budget != 100 {
+		t.Errorf("expected no nodes to be visited, got %d", 100-p.budget)
+	}
+}
+
+func TestPrefetchMissingState(t *testing.T) {
+	db, parent, _, _ := prefetchTestStates(t)
+	// a pruned or unknown state is skipped without resolving anything
+	p := newTestPrefetch(db, 100, 0)
+	if result := p.walkState(parent, common.HexToHash("0x01")); result != prefetchUnavailable {
+		t.Fatalf("expected the state to be unavailable, got %s", result)
+	}
+	if p.err == nil {
+		t.Error("expected the error opening the state to be kept")
+	}
+	if p.budget != 100 {
+		t.Errorf("expected no nodes to be visited, got %d", 100-p.budget)
+	}
+}
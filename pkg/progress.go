@@ -0,0 +1,117 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+// weight of the latest block in the worker's average block interval
+const rateSmoothing = 0.1
+
+// workerProgress reports the progress of a worker, and of the job it is processing, to the labeled metrics
+type workerProgress struct {
+	worker string
+	// whether the worker only processes interactive requests
+	interactive bool
+	// time the last block was written, or the current batch was started
+	last time.Time
+	// moving average of the seconds between written blocks
+	interval float64
+
+	// the following are guarded by the mutex, as they are read by the liveness check
+
+	mtx  sync.Mutex
+	job  *rangeJob
+	busy bool
+	// next block of the batch to be finished, and the time the previous one was finished
+	block      uint64
+	progressed time.Time
+}
+
+func newWorkerProgress(id int, interactive bool) *workerProgress {
+	return &workerProgress{worker: strconv.Itoa(id), interactive: interactive}
+}
+
+// startBatch is called when the worker starts processing a batch of the job
+func (p *workerProgress) startBatch(job *rangeJob, start uint64) {
+	p.last = time.Now()
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.job, p.busy, p.block, p.progressed = job, true, start, p.last
+}
+
+// endBatch is called when the worker has finished its batch
+func (p *workerProgress) endBatch() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.busy = false
+}
+
+// advance records that the worker finished the given block
+func (p *workerProgress) advance(number uint64) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.block, p.progressed = number+1, time.Now()
+}
+
+// current returns the block the worker is working on and since when, if it is busy
+func (p *workerProgress) current() (job *rangeJob, block uint64, since time.Time, busy bool) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.job, p.block, p.progressed, p.busy
+}
+
+// blockWritten records a block committed by the worker
+func (p *workerProgress) blockWritten(b *pendingBlock) {
+	p.advance(b.number)
+	now := time.Now()
+	interval := now.Sub(p.last).Seconds()
+	p.last = now
+	if p.interval == 0 {
+		p.interval = interval
+	} else {
+		p.interval += rateSmoothing * (interval - p.interval)
+	}
+	nodes := b.timing.StateNodes + b.timing.StorageNodes
+	prom.ObserveWorkerBlock(p.worker, b.number, b.size, nodes)
+	if p.interval > 0 {
+		prom.SetWorkerBlockRate(p.worker, 1/p.interval)
+	}
+	prom.ObserveJobBlock(p.job.label(), p.job.observeHeight(b.number), b.size, nodes)
+}
+
+// blockSkipped records a block skipped by the worker
+func (p *workerProgress) blockSkipped(number uint64) {
+	p.advance(number)
+}
+
+// blockFailed records a block which failed on the worker
+func (p *workerProgress) blockFailed(number uint64) {
+	p.advance(number)
+	prom.IncWorkerFailedBlocks(p.worker)
+	prom.IncJobFailedBlocks(p.job.label())
+}
+
+// close resets the rate of the worker once it has exited. Its totals are kept, and continued by the
+// next worker started under the same ID.
+func (p *workerProgress) close() {
+	prom.SetWorkerBlockRate(p.worker, 0)
+}
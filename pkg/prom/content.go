@@ -0,0 +1,110 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const diffSubsystem = "diff"
+
+var (
+	diffItems       *prometheus.CounterVec
+	diffBlockItems  *prometheus.HistogramVec
+	diffBytes       prometheus.Counter
+	diffBlockBytes  prometheus.Histogram
+	diffEmptyBlocks prometheus.Counter
+)
+
+const (
+	DIFF_ITEMS        = "items_total"
+	DIFF_BLOCK_ITEMS  = "block_items"
+	DIFF_BYTES        = "bytes_total"
+	DIFF_BLOCK_BYTES  = "block_bytes"
+	DIFF_EMPTY_BLOCKS = "empty_blocks"
+)
+
+// Values of the kind label of the diff item metrics
+const (
+	DIFF_STATE_NODES   = "state_nodes"
+	DIFF_STORAGE_NODES = "storage_nodes"
+	DIFF_REMOVED_NODES = "removed_nodes"
+	DIFF_IPLDS         = "iplds"
+	DIFF_CODES         = "codes"
+	DIFF_TRANSACTIONS  = "transactions"
+	DIFF_RECEIPTS      = "receipts"
+	DIFF_LOGS          = "logs"
+)
+
+func initContentMetrics() {
+	diffItems = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: diffSubsystem,
+		Name:      DIFF_ITEMS,
+		Help:      "Number of items of each kind written",
+	}, []string{"kind"})
+	diffBlockItems = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: diffSubsystem,
+		Name:      DIFF_BLOCK_ITEMS,
+		Help:      "Number of items of each kind written per block",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 10),
+	}, []string{"kind"})
+	diffBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: diffSubsystem,
+		Name:      DIFF_BYTES,
+		Help:      "Approximate number of bytes written to the indexer",
+	})
+	diffBlockBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: diffSubsystem,
+		Name:      DIFF_BLOCK_BYTES,
+		Help:      "Approximate number of bytes written to the indexer per block",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	diffEmptyBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: diffSubsystem,
+		Name:      DIFF_EMPTY_BLOCKS,
+		Help:      "Number of blocks written without any state changes",
+	})
+}
+
+// ObserveDiffItems records the number of items of a kind written for a block
+func ObserveDiffItems(kind string, n uint64) {
+	if metrics {
+		diffItems.WithLabelValues(kind).Add(float64(n))
+		diffBlockItems.WithLabelValues(kind).Observe(float64(n))
+	}
+}
+
+// ObserveDiffBytes records the number of bytes written for a block
+func ObserveDiffBytes(n uint64) {
+	if metrics {
+		diffBytes.Add(float64(n))
+		diffBlockBytes.Observe(float64(n))
+	}
+}
+
+// IncEmptyDiffs increments the number of blocks written without state changes
+func IncEmptyDiffs() {
+	if metrics {
+		diffEmptyBlocks.Inc()
+	}
+}
@@ -0,0 +1,165 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	workerSubsystem = "worker"
+	jobSubsystem    = "job"
+)
+
+// progressMetrics are the progress metrics of one kind of label (worker or job)
+type progressMetrics struct {
+	height    *prometheus.GaugeVec
+	processed *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	bytes     *prometheus.CounterVec
+	nodes     *prometheus.CounterVec
+	rate      *prometheus.GaugeVec
+}
+
+var workerProgress, jobProgress progressMetrics
+
+const (
+	PROGRESS_HEIGHT    = "height"
+	PROGRESS_PROCESSED = "blocks_processed"
+	PROGRESS_FAILED    = "blocks_failed"
+	PROGRESS_BYTES     = "bytes_written"
+	PROGRESS_NODES     = "nodes_written"
+	PROGRESS_RATE      = "blocks_per_second"
+)
+
+func newProgressMetrics(subsystem, label, height, rate string) progressMetrics {
+	labels := []string{label}
+	return progressMetrics{
+		height: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_HEIGHT,
+			Help:      height,
+		}, labels),
+		processed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_PROCESSED,
+			Help:      "Number of blocks written per " + label,
+		}, labels),
+		failed: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_FAILED,
+			Help:      "Number of blocks that failed per " + label,
+		}, labels),
+		bytes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_BYTES,
+			Help:      "Approximate number of bytes written per " + label,
+		}, labels),
+		nodes: promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_NODES,
+			Help:      "Number of state and storage nodes written per " + label,
+		}, labels),
+		rate: promauto.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      PROGRESS_RATE,
+			Help:      rate,
+		}, labels),
+	}
+}
+
+func initProgressMetrics() {
+	workerProgress = newProgressMetrics(workerSubsystem, "worker",
+		"The last block written by the worker",
+		"Recent rate of blocks written by the worker")
+	jobProgress = newProgressMetrics(jobSubsystem, "job",
+		"The highest block written for the range job",
+		"Rate of blocks written for the range job since it was started")
+}
+
+func (m progressMetrics) observeBlock(label string, bytes, nodes uint64) {
+	m.processed.WithLabelValues(label).Inc()
+	m.bytes.WithLabelValues(label).Add(float64(bytes))
+	m.nodes.WithLabelValues(label).Add(float64(nodes))
+}
+
+func (m progressMetrics) delete(label string) {
+	m.height.DeleteLabelValues(label)
+	m.processed.DeleteLabelValues(label)
+	m.failed.DeleteLabelValues(label)
+	m.bytes.DeleteLabelValues(label)
+	m.nodes.DeleteLabelValues(label)
+	m.rate.DeleteLabelValues(label)
+}
+
+// ObserveWorkerBlock records a block written by the worker
+func ObserveWorkerBlock(worker string, height, bytes, nodes uint64) {
+	if metrics {
+		workerProgress.height.WithLabelValues(worker).Set(float64(height))
+		workerProgress.observeBlock(worker, bytes, nodes)
+	}
+}
+
+// IncWorkerFailedBlocks increments the number of blocks that failed on the worker
+func IncWorkerFailedBlocks(worker string) {
+	if metrics {
+		workerProgress.failed.WithLabelValues(worker).Inc()
+	}
+}
+
+// SetWorkerBlockRate sets the recent rate of blocks written by the worker
+func SetWorkerBlockRate(worker string, rate float64) {
+	if metrics {
+		workerProgress.rate.WithLabelValues(worker).Set(rate)
+	}
+}
+
+// ObserveJobBlock records a block written for the job; height is the highest block written for it so far
+func ObserveJobBlock(job string, height, bytes, nodes uint64) {
+	if metrics {
+		jobProgress.height.WithLabelValues(job).Set(float64(height))
+		jobProgress.observeBlock(job, bytes, nodes)
+	}
+}
+
+// IncJobFailedBlocks increments the number of blocks that failed for the job
+func IncJobFailedBlocks(job string) {
+	if metrics {
+		jobProgress.failed.WithLabelValues(job).Inc()
+	}
+}
+
+// SetJobBlockRate sets the rate of blocks written for the job
+func SetJobBlockRate(job string, rate float64) {
+	if metrics {
+		jobProgress.rate.WithLabelValues(job).Set(rate)
+	}
+}
+
+// DeleteJobMetrics removes the metrics of a job
+func DeleteJobMetrics(job string) {
+	if metrics {
+		jobProgress.delete(job)
+	}
+}
@@ -33,8 +33,27 @@ var (
 	metrics bool
 
 	queuedRanges        prometheus.Gauge
+	priorityRanges      *prometheus.GaugeVec
+	priorityBlocks      *prometheus.GaugeVec
 	lastLoadedHeight    prometheus.Gauge
 	lastProcessedHeight prometheus.Gauge
+	skippedBlocks       prometheus.Counter
+	errorsTotal         *prometheus.CounterVec
+	serviceWorkers      prometheus.Gauge
+	trieWorkers         prometheus.Gauge
+	paused              prometheus.Gauge
+	throttleLimit       prometheus.Gauge
+	throttleDelay       prometheus.Gauge
+	memoryBudget        prometheus.Gauge
+	memoryReserved      prometheus.Gauge
+	blockMemory         prometheus.Histogram
+	trieNodeReads       prometheus.Counter
+	prefetchedNodes     prometheus.Counter
+	prefetchedBlocks    *prometheus.CounterVec
+
+	stageBusy        *prometheus.CounterVec
+	stageBlocked     *prometheus.CounterVec
+	stageQueueLength *prometheus.GaugeVec
 
 	tBlockLoad       prometheus.Histogram
 	tBlockProcessing prometheus.Histogram
@@ -48,8 +67,26 @@ var (
 
 const (
 	RANGES_QUEUED        = "ranges_queued"
+	PRIORITY_RANGES      = "priority_ranges_queued"
+	PRIORITY_BLOCKS      = "priority_blocks_queued"
 	LOADED_HEIGHT        = "loaded_height"
 	PROCESSED_HEIGHT     = "processed_height"
+	ERRORS_TOTAL         = "errors_total"
+	BLOCKS_SKIPPED       = "blocks_skipped"
+	SERVICE_WORKERS      = "service_workers"
+	TRIE_WORKERS         = "trie_workers"
+	PAUSED               = "paused"
+	THROTTLE_LIMIT       = "throttle_limit"
+	THROTTLE_DELAY       = "throttle_delay_seconds"
+	MEMORY_BUDGET        = "memory_budget_bytes"
+	MEMORY_RESERVED      = "memory_reserved_bytes"
+	BLOCK_MEMORY         = "block_memory_bytes"
+	TRIE_NODE_READS      = "trie_node_db_reads"
+	PREFETCHED_NODES     = "prefetched_nodes"
+	PREFETCHED_BLOCKS    = "prefetched_blocks"
+	STAGE_BUSY_SECONDS   = "stage_busy_seconds"
+	STAGE_BLOCKED        = "stage_blocked_seconds"
+	STAGE_QUEUE_LENGTH   = "stage_queue_length"
 	T_BLOCK_LOAD         = "t_block_load"
 	T_BLOCK_PROCESSING   = "t_block_processing"
 	T_STATE_PROCESSING   = "t_state_processing"
@@ -65,6 +102,16 @@ func Init() {
 		Name:      RANGES_QUEUED,
 		Help:      "Number of range requests currently queued",
 	})
+	priorityRanges = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      PRIORITY_RANGES,
+		Help:      "Number of range requests currently queued per priority class",
+	}, []string{"priority"})
+	priorityBlocks = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      PRIORITY_BLOCKS,
+		Help:      "Number of queued blocks not yet handed out to a worker per priority class",
+	}, []string{"priority"})
 	lastLoadedHeight = promauto.NewGauge(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name:      LOADED_HEIGHT,
@@ -75,6 +122,95 @@ func Init() {
 		Name:      PROCESSED_HEIGHT,
 		Help:      "The last block that was processed",
 	})
+	skippedBlocks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      BLOCKS_SKIPPED,
+		Help:      "Number of blocks skipped because they were already complete",
+	})
+	errorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      ERRORS_TOTAL,
+		Help:      "Number of failed blocks and requests per type of error",
+	}, []string{"type"})
+	serviceWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      SERVICE_WORKERS,
+		Help:      "Number of service workers processing ranges",
+	})
+	trieWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      TRIE_WORKERS,
+		Help:      "Number of subtrie workers used per block",
+	})
+	paused = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      PAUSED,
+		Help:      "Whether processing of queued ranges is paused",
+	})
+	throttleLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      THROTTLE_LIMIT,
+		Help:      "Maximum number of blocks concurrently written to the database by the throttle",
+	})
+	throttleDelay = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      THROTTLE_DELAY,
+		Help:      "Delay inserted by the throttle before writing each block",
+	})
+	memoryBudget = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      MEMORY_BUDGET,
+		Help:      "Memory budget for the blocks in processing",
+	})
+	memoryReserved = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      MEMORY_RESERVED,
+		Help:      "Estimated memory of the blocks in processing",
+	})
+	blockMemory = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      BLOCK_MEMORY,
+		Help:      "Estimated peak memory per block",
+		Buckets:   prometheus.ExponentialBuckets(1<<20, 2, 14),
+	})
+	trieNodeReads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      TRIE_NODE_READS,
+		Help:      "Number of trie nodes read from the database because they missed the trie cache",
+	})
+	prefetchedNodes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      PREFETCHED_NODES,
+		Help:      "Number of trie nodes resolved by the prefetcher",
+	})
+	prefetchedBlocks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      PREFETCHED_BLOCKS,
+		Help:      "Number of blocks prefetched, by whether the prefetch completed, hit the node limit or was overtaken by the diff",
+	}, []string{"result"})
+
+	stageBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      STAGE_BUSY_SECONDS,
+		Help:      "Time spent working in each block processing pipeline stage",
+	}, []string{"stage"})
+	stageBlocked = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      STAGE_BLOCKED,
+		Help:      "Time spent waiting to hand blocks to each pipeline stage because its queue was full",
+	}, []string{"stage"})
+	stageQueueLength = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: statsSubsystem,
+		Name:      STAGE_QUEUE_LENGTH,
+		Help:      "Number of blocks queued for each pipeline stage",
+	}, []string{"stage"})
 
 	tBlockLoad = promauto.NewHistogram(prometheus.HistogramOpts{
 		Namespace: namespace,
@@ -119,6 +255,10 @@ func Init() {
 		Name:      "count",
 		Help:      "unix socket connection count",
 	})
+
+	initProgressMetrics()
+	initContentMetrics()
+	initReaderMetrics()
 }
 
 // RegisterDBCollector create metric collector for given connection
@@ -129,16 +269,25 @@ func RegisterDBCollector(name string, db DBStatsGetter) {
 }
 
 // IncQueuedRanges increments the number of queued range requests
-func IncQueuedRanges() {
+func IncQueuedRanges(priority string) {
 	if metrics {
 		queuedRanges.Inc()
+		priorityRanges.WithLabelValues(priority).Inc()
 	}
 }
 
 // DecQueuedRanges decrements the number of queued range requests
-func DecQueuedRanges() {
+func DecQueuedRanges(priority string) {
 	if metrics {
 		queuedRanges.Dec()
+		priorityRanges.WithLabelValues(priority).Dec()
+	}
+}
+
+// AddQueuedBlocks adds to the number of queued blocks in the priority class
+func AddQueuedBlocks(priority string, blocks float64) {
+	if metrics {
+		priorityBlocks.WithLabelValues(priority).Add(blocks)
 	}
 }
 
@@ -156,6 +305,123 @@ func SetLastProcessedHeight(height int64) {
 	}
 }
 
+// IncSkippedBlocks increments the number of blocks skipped as already complete
+func IncSkippedBlocks() {
+	if metrics {
+		skippedBlocks.Inc()
+	}
+}
+
+// IncErrors increments the number of errors of the type
+func IncErrors(errType string) {
+	if metrics {
+		errorsTotal.WithLabelValues(errType).Inc()
+	}
+}
+
+// SetServiceWorkers sets the number of service workers
+func SetServiceWorkers(n int) {
+	if metrics {
+		serviceWorkers.Set(float64(n))
+	}
+}
+
+// SetTrieWorkers sets the number of subtrie workers
+func SetTrieWorkers(n int) {
+	if metrics {
+		trieWorkers.Set(float64(n))
+	}
+}
+
+// SetPaused sets whether processing is paused
+func SetPaused(p bool) {
+	if metrics {
+		if p {
+			paused.Set(1)
+		} else {
+			paused.Set(0)
+		}
+	}
+}
+
+// SetThrottle sets the current concurrency limit and delay of the database throttle
+func SetThrottle(limit int, delay time.Duration) {
+	if metrics {
+		throttleLimit.Set(float64(limit))
+		throttleDelay.Set(delay.Seconds())
+	}
+}
+
+// SetMemoryBudget sets the memory budget for blocks in processing
+func SetMemoryBudget(n uint64) {
+	if metrics {
+		memoryBudget.Set(float64(n))
+	}
+}
+
+// SetMemoryReserved sets the estimated memory of the blocks in processing
+func SetMemoryReserved(n uint64) {
+	if metrics {
+		memoryReserved.Set(float64(n))
+	}
+}
+
+// ObserveBlockMemory records the estimated peak memory of a block
+func ObserveBlockMemory(n uint64) {
+	if metrics {
+		blockMemory.Observe(float64(n))
+	}
+}
+
+// IncTrieNodeReads increments the number of trie nodes read from the database
+func IncTrieNodeReads() {
+	if metrics {
+		trieNodeReads.Inc()
+	}
+}
+
+// AddPrefetchedNodes adds to the number of trie nodes resolved by the prefetcher
+func AddPrefetchedNodes(n uint) {
+	if metrics {
+		prefetchedNodes.Add(float64(n))
+	}
+}
+
+// IncPrefetchedBlocks increments the number of prefetched blocks with the given result
+func IncPrefetchedBlocks(result string) {
+	if metrics {
+		prefetchedBlocks.WithLabelValues(result).Inc()
+	}
+}
+
+// AddStageBusyTime adds to the time spent working in the given pipeline stage
+func AddStageBusyTime(stage string, t time.Duration) {
+	if metrics {
+		stageBusy.WithLabelValues(stage).Add(t.Seconds())
+	}
+}
+
+// AddStageBlockedTime adds to the time spent waiting on the queue of the given pipeline stage
+func AddStageBlockedTime(stage string, t time.Duration) {
+	if metrics {
+		stageBlocked.WithLabelValues(stage).Add(t.Seconds())
+	}
+}
+
+// IncStageQueueLength increments the number of blocks queued for the given pipeline stage
+func IncStageQueueLength(stage string) {
+	if metrics {
+		stageQueueLength.WithLabelValues(stage).Inc()
+	}
+}
+
+// DecStageQueueLength decrements the number of blocks queued for the given pipeline stage
+func DecStageQueueLength(stage string) {
+	if metrics {
+		stageQueueLength.WithLabelValues(stage).Dec()
+	}
+}
+
 // SetTimeMetric time metric observation
 func SetTimeMetric(name string, t time.Duration) {
 	if !metrics {
@@ -0,0 +1,150 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package prom
+
+import (
+	"time"
+
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	readerSubsystem    = "reader"
+	trieCacheSubsystem = "trie_cache"
+)
+
+var (
+	readDuration  *prometheus.HistogramVec
+	readErrors    *prometheus.CounterVec
+	trieCacheSize prometheus.Gauge
+)
+
+const (
+	READ_DURATION   = "read_duration_seconds"
+	READ_ERRORS     = "read_errors"
+	TRIE_CACHE_SIZE = "max_bytes"
+)
+
+func initReaderMetrics() {
+	readDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: readerSubsystem,
+		Name:      READ_DURATION,
+		Help:      "Latency of reads from LevelDB per reader method",
+		Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"method"})
+	readErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: readerSubsystem,
+		Name:      READ_ERRORS,
+		Help:      "Number of failed reads from LevelDB per reader method",
+	}, []string{"method"})
+	trieCacheSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: trieCacheSubsystem,
+		Name:      TRIE_CACHE_SIZE,
+		Help:      "Capacity of the trie cache in bytes",
+	})
+	prometheus.MustRegister(NewTrieCacheCollector())
+}
+
+// SetTrieCacheSize sets the capacity of the trie cache
+func SetTrieCacheSize(n uint64) {
+	if metrics {
+		trieCacheSize.Set(float64(n))
+	}
+}
+
+// ObserveRead records the latency of a read by the reader method, and whether it failed
+func ObserveRead(method string, d time.Duration, failed bool) {
+	if metrics {
+		readDuration.WithLabelValues(method).Observe(d.Seconds())
+		if failed {
+			readErrors.WithLabelValues(method).Inc()
+		}
+	}
+}
+
+// Meters of go-ethereum's trie clean cache. They are only updated if go-ethereum's metrics were
+// enabled before its trie package was initialized, see the gethmetrics package.
+const (
+	trieCacheHitMeter   = "trie/memcache/clean/hit"
+	trieCacheMissMeter  = "trie/memcache/clean/miss"
+	trieCacheReadMeter  = "trie/memcache/clean/read"
+	trieCacheWriteMeter = "trie/memcache/clean/write"
+)
+
+// TrieCacheCollector implements the prometheus.Collector interface, exporting the meters of the
+// trie clean cache on each scrape
+type TrieCacheCollector struct {
+	hitsDesc       *prometheus.Desc
+	missesDesc     *prometheus.Desc
+	readBytesDesc  *prometheus.Desc
+	writeBytesDesc *prometheus.Desc
+}
+
+// NewTrieCacheCollector creates a new TrieCacheCollector
+func NewTrieCacheCollector() *TrieCacheCollector {
+	return &TrieCacheCollector{
+		hitsDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, trieCacheSubsystem, "hits"),
+			"Number of trie node reads served by the trie cache.",
+			nil, nil,
+		),
+		missesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, trieCacheSubsystem, "misses"),
+			"Number of trie node reads which missed the trie cache.",
+			nil, nil,
+		),
+		readBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, trieCacheSubsystem, "read_bytes"),
+			"Number of bytes of trie nodes read from the trie cache.",
+			nil, nil,
+		),
+		writeBytesDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, trieCacheSubsystem, "write_bytes"),
+			"Number of bytes of trie nodes written to the trie cache.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements the prometheus.Collector interface.
+func (c TrieCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hitsDesc
+	ch <- c.missesDesc
+	ch <- c.readBytesDesc
+	ch <- c.writeBytesDesc
+}
+
+// Collect implements the prometheus.Collector interface.
+func (c TrieCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.hitsDesc, prometheus.CounterValue, meterCount(trieCacheHitMeter))
+	ch <- prometheus.MustNewConstMetric(c.missesDesc, prometheus.CounterValue, meterCount(trieCacheMissMeter))
+	ch <- prometheus.MustNewConstMetric(c.readBytesDesc, prometheus.CounterValue, meterCount(trieCacheReadMeter))
+	ch <- prometheus.MustNewConstMetric(c.writeBytesDesc, prometheus.CounterValue, meterCount(trieCacheWriteMeter))
+}
+
+// meterCount returns the count of a meter in go-ethereum's metrics registry, zero if there is none
+func meterCount(name string) float64 {
+	if meter, ok := gethmetrics.DefaultRegistry.Get(name).(gethmetrics.Meter); ok {
+		return float64(meter.Count())
+	}
+	return 0
+}
@@ -23,9 +23,16 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// mux serves the metrics, along with any handlers registered with Handle
+var mux = http.NewServeMux()
+
+// Handle registers a handler to be served next to the metrics
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
 // Listen start listening http
 func Listen(addr string) *http.Server {
-	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
 	srv := http.Server{
 		Addr:    addr,
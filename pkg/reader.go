@@ -16,9 +16,9 @@
 package statediff
 
 import (
-	"errors"
 	"fmt"
 	"math/big"
+	"time"
 
 	"github.com/cerc-io/leveldb-ethdb-rpc/pkg/client"
 	"github.com/ethereum/go-ethereum/common"
@@ -28,12 +28,16 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/trie"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
 )
 
-// Reader interface required by the statediffing service
+// Reader interface required by the statediffing service.
+// Missing data is reported with errors wrapping ErrBlockNotFound or ErrReceiptsMissing.
 type Reader interface {
 	GetBlockByHash(hash common.Hash) (*types.Block, error)
 	GetBlockByNumber(number uint64) (*types.Block, error)
+	GetCanonicalHash(number uint64) (common.Hash, error)
 	GetReceiptsByHash(hash common.Hash) (types.Receipts, error)
 	GetTdByHash(hash common.Hash) (*big.Int, error)
 	StateDB() state.Database
@@ -79,57 +83,93 @@ func NewLvlDBReader(conf LvLDBReaderConfig) (*LvlDBReader, error) {
 		}
 	}
 
+	if conf.TrieConfig != nil {
+		prom.SetTrieCacheSize(uint64(conf.TrieConfig.Cache) << 20)
+	}
+	// only the trie database reads through the counter, contract code is read from edb directly
+	triedb := trie.NewDatabaseWithConfig(nodeReadCounter{edb}, conf.TrieConfig)
 	return &LvlDBReader{
 		ethDB:       edb,
-		stateDB:     state.NewDatabaseWithConfig(edb, conf.TrieConfig),
+		stateDB:     state.NewDatabaseWithNodeDB(edb, triedb),
 		chainConfig: conf.ChainConfig,
 	}, nil
 }
 
+// Reader methods, as labels of the read metrics
+const (
+	readBlockByHash   = "GetBlockByHash"
+	readBlockByNumber = "GetBlockByNumber"
+	readCanonicalHash = "GetCanonicalHash"
+	readReceipts      = "GetReceiptsByHash"
+	readTd            = "GetTdByHash"
+	readLatestHeader  = "GetLatestHeader"
+	// reads of trie nodes which missed the trie cache
+	readTrieNode = "TrieNode"
+)
+
+// observeRead records the latency of a read started at the given time, and whether it failed
+func observeRead(method string, start time.Time, err *error) {
+	prom.ObserveRead(method, time.Since(start), *err != nil)
+}
+
 // GetBlockByHash gets block by hash
-func (ldr *LvlDBReader) GetBlockByHash(hash common.Hash) (*types.Block, error) {
+func (ldr *LvlDBReader) GetBlockByHash(hash common.Hash) (block *types.Block, err error) {
+	defer observeRead(readBlockByHash, time.Now(), &err)
 	height := rawdb.ReadHeaderNumber(ldr.ethDB, hash)
 	if height == nil {
-		return nil, fmt.Errorf("unable to read header height for header hash %s", hash)
+		return nil, fmt.Errorf("unable to read header height for header hash %s: %w", hash, ErrBlockNotFound)
 	}
-	block := rawdb.ReadBlock(ldr.ethDB, hash, *height)
+	block = rawdb.ReadBlock(ldr.ethDB, hash, *height)
 	if block == nil {
-		return nil, fmt.Errorf("unable to read block at height %d hash %s", *height, hash)
+		return nil, fmt.Errorf("unable to read block at height %d hash %s: %w", *height, hash, ErrBlockNotFound)
 	}
 	return block, nil
 }
 
-func (ldr *LvlDBReader) GetBlockByNumber(number uint64) (*types.Block, error) {
+func (ldr *LvlDBReader) GetBlockByNumber(number uint64) (block *types.Block, err error) {
+	defer observeRead(readBlockByNumber, time.Now(), &err)
 	hash := rawdb.ReadCanonicalHash(ldr.ethDB, number)
-	block := rawdb.ReadBlock(ldr.ethDB, hash, number)
+	block = rawdb.ReadBlock(ldr.ethDB, hash, number)
 	if block == nil {
-		return nil, fmt.Errorf("unable to read block at height %d hash %s", number, hash)
+		return nil, fmt.Errorf("unable to read block at height %d hash %s: %w", number, hash, ErrBlockNotFound)
 	}
 	return block, nil
 }
 
+// GetCanonicalHash gets the canonical block hash at the given height
+func (ldr *LvlDBReader) GetCanonicalHash(number uint64) (hash common.Hash, err error) {
+	defer observeRead(readCanonicalHash, time.Now(), &err)
+	hash = rawdb.ReadCanonicalHash(ldr.ethDB, number)
+	if hash == (common.Hash{}) {
+		return common.Hash{}, fmt.Errorf("unable to read canonical hash at height %d: %w", number, ErrBlockNotFound)
+	}
+	return hash, nil
+}
+
 // GetReceiptsByHash gets receipt by hash
-func (ldr *LvlDBReader) GetReceiptsByHash(hash common.Hash) (types.Receipts, error) {
+func (ldr *LvlDBReader) GetReceiptsByHash(hash common.Hash) (receipts types.Receipts, err error) {
+	defer observeRead(readReceipts, time.Now(), &err)
 	number := rawdb.ReadHeaderNumber(ldr.ethDB, hash)
 	if number == nil {
-		return nil, fmt.Errorf("unable to read header height for header hash %s", hash)
+		return nil, fmt.Errorf("unable to read header height for header hash %s: %w", hash, ErrBlockNotFound)
 	}
-	receipts := rawdb.ReadReceipts(ldr.ethDB, hash, *number, ldr.chainConfig)
+	receipts = rawdb.ReadReceipts(ldr.ethDB, hash, *number, ldr.chainConfig)
 	if receipts == nil {
-		return nil, fmt.Errorf("unable to read receipts at height %d hash %s", number, hash)
+		return nil, fmt.Errorf("unable to read receipts at height %d hash %s: %w", *number, hash, ErrReceiptsMissing)
 	}
 	return receipts, nil
 }
 
 // GetTdByHash gets td by hash
-func (ldr *LvlDBReader) GetTdByHash(hash common.Hash) (*big.Int, error) {
+func (ldr *LvlDBReader) GetTdByHash(hash common.Hash) (td *big.Int, err error) {
+	defer observeRead(readTd, time.Now(), &err)
 	number := rawdb.ReadHeaderNumber(ldr.ethDB, hash)
 	if number == nil {
-		return nil, fmt.Errorf("unable to read header height for header hash %s", hash)
+		return nil, fmt.Errorf("unable to read header height for header hash %s: %w", hash, ErrBlockNotFound)
 	}
-	td := rawdb.ReadTd(ldr.ethDB, hash, *number)
+	td = rawdb.ReadTd(ldr.ethDB, hash, *number)
 	if td == nil {
-		return nil, fmt.Errorf("unable to read total difficulty at height %d hash %s", number, hash)
+		return nil, fmt.Errorf("unable to read total difficulty at height %d hash %s: %w", *number, hash, ErrBlockNotFound)
 	}
 	return td, nil
 }
@@ -140,10 +180,11 @@ func (ldr *LvlDBReader) StateDB() state.Database {
 }
 
 // GetLatestHeader gets the latest header from the levelDB
-func (ldr *LvlDBReader) GetLatestHeader() (*types.Header, error) {
-	header := rawdb.ReadHeadHeader(ldr.ethDB)
+func (ldr *LvlDBReader) GetLatestHeader() (header *types.Header, err error) {
+	defer observeRead(readLatestHeader, time.Now(), &err)
+	header = rawdb.ReadHeadHeader(ldr.ethDB)
 	if header == nil {
-		return nil, errors.New("unable to read head header")
+		return nil, fmt.Errorf("unable to read head header: %w", ErrBlockNotFound)
 	}
 	return header, nil
 }
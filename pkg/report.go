@@ -0,0 +1,84 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"sort"
+	"time"
+)
+
+// RangeReport summarizes the processing of a range in a run
+type RangeReport struct {
+	Start     uint64 `json:"start"`
+	Stop      uint64 `json:"stop"`
+	Processed uint64 `json:"processed"`
+	Skipped   uint64 `json:"skipped"`
+	Failed    uint64 `json:"failed"`
+	// heights of the failed blocks, up to the first 1000
+	FailedHeights []uint64 `json:"failedHeights,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// RunReport summarizes a one-off processing run
+type RunReport struct {
+	Started         time.Time     `json:"started"`
+	Finished        time.Time     `json:"finished"`
+	DurationSeconds float64       `json:"durationSeconds"`
+	Ranges          []RangeReport `json:"ranges"`
+	Processed       uint64        `json:"processed"`
+	Skipped         uint64        `json:"skipped"`
+	Failed          uint64        `json:"failed"`
+	FailedHeights   []uint64      `json:"failedHeights,omitempty"`
+	// blocks written per second over the run
+	BlocksPerSecond float64 `json:"blocksPerSecond"`
+	Interrupted     bool    `json:"interrupted"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// newRunReport summarizes the jobs of a run; the workers must have exited
+func newRunReport(started time.Time, jobs []*rangeJob) *RunReport {
+	r := &RunReport{Started: started, Finished: time.Now(), Ranges: make([]RangeReport, 0, len(jobs))}
+	r.DurationSeconds = r.Finished.Sub(started).Seconds()
+	for _, job := range jobs {
+		rng := RangeReport{
+			Start:         job.Start,
+			Stop:          job.Stop,
+			Processed:     job.processed,
+			Skipped:       job.skipped,
+			Failed:        job.failed,
+			FailedHeights: job.failedHeights,
+		}
+		if job.err != nil {
+			rng.Error = job.err.Error()
+		}
+		r.Ranges = append(r.Ranges, rng)
+		r.Processed += job.processed
+		r.Skipped += job.skipped
+		r.Failed += job.failed
+		r.FailedHeights = append(r.FailedHeights, job.failedHeights...)
+	}
+	sort.Slice(r.FailedHeights, func(i, j int) bool { return r.FailedHeights[i] < r.FailedHeights[j] })
+	if r.DurationSeconds > 0 {
+		r.BlocksPerSecond = float64(r.Processed) / r.DurationSeconds
+	}
+	return r
+}
+
+// failed records the error which ended the run
+func (r *RunReport) failed(err error) (*RunReport, error) {
+	r.Error = err.Error()
+	return r, err
+}
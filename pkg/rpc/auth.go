@@ -0,0 +1,224 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// maximum difference between the issued-at time of a JWT and now, as for the engine API
+const jwtExpiryTimeout = 60 * time.Second
+
+// AuthConfig configures token authentication of the HTTP and websocket endpoints
+type AuthConfig struct {
+	// HS256 secret of JWTs, which must carry an issued-at claim within 60 seconds of now
+	JWTSecret []byte
+	// static bearer tokens
+	Tokens []string
+	// namespaces (e.g. "admin") and methods (e.g. "statediff_writeStateDiffsInRange") which require a
+	// token; everything requires one if empty
+	Protected []string
+}
+
+// Enabled reports whether any tokens are accepted, otherwise no authentication is required
+func (c AuthConfig) Enabled() bool {
+	return len(c.JWTSecret) != 0 || len(c.Tokens) != 0
+}
+
+// protects reports whether the method, or its whole namespace, requires a token
+func (c AuthConfig) protects(method string) bool {
+	if len(c.Protected) == 0 {
+		return true
+	}
+	namespace, _, _ := strings.Cut(method, "_")
+	for _, p := range c.Protected {
+		if p == method || p == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// protectsAny reports whether any method of the namespace requires a token
+func (c AuthConfig) protectsAny(namespace string) bool {
+	if len(c.Protected) == 0 {
+		return true
+	}
+	for _, p := range c.Protected {
+		if p == namespace || strings.HasPrefix(p, namespace+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate checks the bearer token of the request, returning false if there is none,
+// and an error if it is not valid
+func (c AuthConfig) authenticate(r *http.Request) (bool, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return false, nil
+	}
+	token := strings.TrimPrefix(auth, "Bearer ")
+	if token == auth || token == "" {
+		return false, errors.New("malformed authorization header")
+	}
+	for _, t := range c.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			return true, nil
+		}
+	}
+	if len(c.JWTSecret) == 0 {
+		return false, errors.New("invalid token")
+	}
+	return true, c.verifyJWT(token)
+}
+
+// verifyJWT checks the signature and issued-at time of the JWT
+func (c AuthConfig) verifyJWT(s string) error {
+	var claims jwt.RegisteredClaims
+	token, err := jwt.ParseWithClaims(s, &claims, func(*jwt.Token) (interface{}, error) {
+		return c.JWTSecret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithoutClaimsValidation())
+	switch {
+	case err != nil:
+		return err
+	case !token.Valid:
+		return errors.New("invalid token")
+	case !claims.VerifyExpiresAt(time.Now(), false):
+		return errors.New("token is expired")
+	case claims.IssuedAt == nil:
+		return errors.New("missing issued-at")
+	case time.Since(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("stale token")
+	case time.Until(claims.IssuedAt.Time) > jwtExpiryTimeout:
+		return errors.New("future token")
+	}
+	return nil
+}
+
+// newAuthHandler requires a token for the protected methods. Authenticated requests are passed to full.
+// Other HTTP requests are passed to full if they only call unprotected methods, or if they have no body (the
+// RPC server's health check); requests whose methods cannot be determined require a token. As websocket
+// messages cannot be inspected, other websocket connections are passed to open, which only serves the
+// namespaces without protected methods.
+func newAuthHandler(conf AuthConfig, full, open http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticated, err := conf.authenticate(r)
+		switch {
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case authenticated:
+			full.ServeHTTP(w, r)
+			return
+		case isWebsocket(r):
+			if open == nil {
+				http.Error(w, "missing token", http.StatusUnauthorized)
+				return
+			}
+			open.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, MaxRequestContentLength+1))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the RPC server serves calls in the body of any method but PUT and DELETE
+		if r.Method != http.MethodPost && len(body) != 0 {
+			http.Error(w, "missing token for "+r.Method+" request with a body", http.StatusUnauthorized)
+			return
+		}
+		if len(body) != 0 {
+			methods, err := requestMethods(body)
+			if err != nil {
+				http.Error(w, "missing token for request: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+			for _, method := range methods {
+				if conf.protects(method) {
+					http.Error(w, "missing token for "+method, http.StatusUnauthorized)
+					return
+				}
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		full.ServeHTTP(w, r)
+	})
+}
+
+// requestMethods returns the methods called by a JSON-RPC request or batch. The body is parsed as the
+// RPC server does: only its first JSON value is read, and each element of a batch is decoded on its own.
+// An error is returned if any method cannot be determined.
+func requestMethods(body []byte) ([]string, error) {
+	var raw json.RawMessage
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&raw); err != nil {
+		return nil, err
+	}
+	elems := []json.RawMessage{raw}
+	if isBatch(raw) {
+		dec := json.NewDecoder(bytes.NewReader(raw))
+		dec.Token() // skip '['
+		elems = elems[:0]
+		for dec.More() {
+			var elem json.RawMessage
+			if err := dec.Decode(&elem); err != nil {
+				return nil, err
+			}
+			elems = append(elems, elem)
+		}
+	}
+	methods := make([]string, 0, len(elems))
+	for _, elem := range elems {
+		var call struct {
+			Method string `json:"method"`
+		}
+		if err := json.Unmarshal(elem, &call); err != nil {
+			return nil, err
+		}
+		methods = append(methods, call.Method)
+	}
+	return methods, nil
+}
+
+// isBatch reports whether the message is a batch, i.e. a JSON array
+func isBatch(raw json.RawMessage) bool {
+	for _, c := range raw {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c == '['
+	}
+	return false
+}
+
+// isWebsocket reports whether the request is a websocket upgrade
+func isWebsocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
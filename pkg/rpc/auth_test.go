@@ -0,0 +1,216 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	testSecret = []byte("0123456789abcdef0123456789abcdef")
+	testToken  = "static-token"
+)
+
+const (
+	servedFull = "full"
+	servedOpen = "open"
+)
+
+// testHandler records the requests it serves, and their bodies
+type testHandler struct {
+	name string
+	body string
+}
+
+func (h *testHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.body = string(body)
+	io.WriteString(w, h.name)
+}
+
+type authRequest struct {
+	method    string
+	body      string
+	auth      string
+	websocket bool
+}
+
+// serveAuth sends the request through an auth handler, and returns the status and the handler which
+// served it, if any
+func serveAuth(t *testing.T, conf AuthConfig, req authRequest, withOpen bool) (int, string) {
+	t.Helper()
+	full := &testHandler{name: servedFull}
+	var open http.Handler
+	if withOpen {
+		open = &testHandler{name: servedOpen}
+	}
+	method := req.method
+	if method == "" {
+		method = http.MethodPost
+	}
+	r := httptest.NewRequest(method, "/", strings.NewReader(req.body))
+	if req.auth != "" {
+		r.Header.Set("Authorization", req.auth)
+	}
+	if req.websocket {
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Connection", "Upgrade")
+	}
+	w := httptest.NewRecorder()
+	newAuthHandler(conf, full, open).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w.Code, ""
+	}
+	served := w.Body.String()
+	if served == servedFull && full.body != req.body {
+		t.Fatalf("expected the body %q to be passed on, got %q", req.body, full.body)
+	}
+	return w.Code, served
+}
+
+func testJWT(t *testing.T, method jwt.SigningMethod, secret []byte, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(method, claims).SignedString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func issuedAt(d time.Duration) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now().Add(d))}
+}
+
+func TestAuthRequestMethods(t *testing.T) {
+	conf := AuthConfig{Tokens: []string{testToken}, Protected: []string{"admin", "statediff_writeStateDiffAt"}}
+	for _, c := range []struct {
+		name   string
+		req    authRequest
+		status int
+	}{
+		{"unprotected call", authRequest{body: `{"jsonrpc":"2.0","id":1,"method":"statediff_stateDiffAt"}`}, http.StatusOK},
+		{"protected namespace", authRequest{body: `{"jsonrpc":"2.0","id":1,"method":"admin_pause"}`}, http.StatusUnauthorized},
+		{"protected method", authRequest{body: `{"method":"statediff_writeStateDiffAt"}`}, http.StatusUnauthorized},
+		{"unprotected batch", authRequest{body: `[{"method":"statediff_stateDiffAt"},{"method":"statediff_writeStateDiffsInRange"}]`}, http.StatusOK},
+		{"protected batch element", authRequest{body: ` [{"method":"statediff_stateDiffAt"},{"method":"admin_pause"}]`}, http.StatusUnauthorized},
+		{"empty batch", authRequest{body: `[]`}, http.StatusOK},
+		// the RPC server decodes batch elements individually, so a bad element doesn't hide the others
+		{"undecodable batch element", authRequest{body: `[{"method":"admin_pause"},{"method":1}]`}, http.StatusUnauthorized},
+		{"malformed batch element", authRequest{body: `[{"method":"statediff_stateDiffAt"},{"method":]`}, http.StatusUnauthorized},
+		{"non-string method", authRequest{body: `{"method":1}`}, http.StatusUnauthorized},
+		{"invalid JSON", authRequest{body: `{"method":"admin_pause"`}, http.StatusUnauthorized},
+		// the RPC server only reads the first JSON value of the body
+		{"trailing garbage", authRequest{body: `{"method":"admin_pause"}]garbage`}, http.StatusUnauthorized},
+		{"unprotected call with trailing garbage", authRequest{body: `{"method":"statediff_stateDiffAt"} {"method":"admin_pause"}`}, http.StatusOK},
+		// health check
+		{"GET without body", authRequest{method: http.MethodGet}, http.StatusOK},
+		{"GET with body", authRequest{method: http.MethodGet, body: `{"method":"admin_pause"}`}, http.StatusUnauthorized},
+		{"PATCH with body", authRequest{method: http.MethodPatch, body: `{"method":"statediff_stateDiffAt"}`}, http.StatusUnauthorized},
+		{"PATCH with token", authRequest{method: http.MethodPatch, body: `{"method":"admin_pause"}`, auth: "Bearer " + testToken}, http.StatusOK},
+		{"token", authRequest{body: `{"method":"admin_pause"}`, auth: "Bearer " + testToken}, http.StatusOK},
+	} {
+		status, served := serveAuth(t, conf, c.req, true)
+		if status != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, status)
+		} else if status == http.StatusOK && served != servedFull {
+			t.Errorf("%s: expected the request to be served by the full handler, got %s", c.name, served)
+		}
+	}
+}
+
+func TestAuthAllProtected(t *testing.T) {
+	conf := AuthConfig{Tokens: []string{testToken}}
+	if status, _ := serveAuth(t, conf, authRequest{body: `{"method":"statediff_stateDiffAt"}`}, true); status != http.StatusUnauthorized {
+		t.Errorf("expected every method to require a token, got status %d", status)
+	}
+	if status, _ := serveAuth(t, conf, authRequest{body: `{"method":"statediff_stateDiffAt"}`, auth: "Bearer " + testToken}, true); status != http.StatusOK {
+		t.Errorf("expected an authenticated request to be served, got status %d", status)
+	}
+}
+
+func TestAuthTokens(t *testing.T) {
+	conf := AuthConfig{JWTSecret: testSecret, Tokens: []string{testToken}, Protected: []string{"admin"}}
+	protected := `{"method":"admin_pause"}`
+	for _, c := range []struct {
+		name   string
+		auth   string
+		status int
+	}{
+		{"bearer token", "Bearer " + testToken, http.StatusOK},
+		{"unknown bearer token", "Bearer other-token", http.StatusUnauthorized},
+		{"malformed header", "Basic " + testToken, http.StatusUnauthorized},
+		{"empty bearer token", "Bearer ", http.StatusUnauthorized},
+		{"JWT", testJWT(t, jwt.SigningMethodHS256, testSecret, issuedAt(0)), http.StatusOK},
+		{"JWT issued recently", testJWT(t, jwt.SigningMethodHS256, testSecret, issuedAt(-30*time.Second)), http.StatusOK},
+		{"JWT with wrong secret", testJWT(t, jwt.SigningMethodHS256, []byte("wrong secret"), issuedAt(0)), http.StatusUnauthorized},
+		{"JWT with other algorithm", testJWT(t, jwt.SigningMethodHS512, testSecret, issuedAt(0)), http.StatusUnauthorized},
+		{"stale JWT", testJWT(t, jwt.SigningMethodHS256, testSecret, issuedAt(-2*jwtExpiryTimeout)), http.StatusUnauthorized},
+		{"future JWT", testJWT(t, jwt.SigningMethodHS256, testSecret, issuedAt(2*jwtExpiryTimeout)), http.StatusUnauthorized},
+		{"JWT without issued-at", testJWT(t, jwt.SigningMethodHS256, testSecret, jwt.RegisteredClaims{}), http.StatusUnauthorized},
+		{"expired JWT", testJWT(t, jwt.SigningMethodHS256, testSecret, jwt.RegisteredClaims{
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Second)),
+		}), http.StatusUnauthorized},
+	} {
+		status, _ := serveAuth(t, conf, authRequest{body: protected, auth: c.auth}, true)
+		if status != c.status {
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, status)
+		}
+	}
+
+	// an invalid token is rejected even for unprotected methods
+	status, _ := serveAuth(t, conf, authRequest{body: `{"method":"statediff_stateDiffAt"}`, auth: "Bearer other-token"}, true)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected an invalid token to be rejected, got status %d", status)
+	}
+
+	// without a JWT secret only the static tokens are accepted
+	conf.JWTSecret = nil
+	status, _ = serveAuth(t, conf, authRequest{body: protected, auth: testJWT(t, jwt.SigningMethodHS256, testSecret, issuedAt(0))}, true)
+	if status != http.StatusUnauthorized {
+		t.Errorf("expected a JWT to be rejected without a secret, got status %d", status)
+	}
+}
+
+func TestAuthWebsocket(t *testing.T) {
+	conf := AuthConfig{Tokens: []string{testToken}, Protected: []string{"admin"}}
+	for _, c := range []struct {
+		name     string
+		req      authRequest
+		withOpen bool
+		status   int
+		served   string
+	}{
+		{"unauthenticated", authRequest{method: http.MethodGet, websocket: true}, true, http.StatusOK, servedOpen},
+		{"authenticated", authRequest{method: http.MethodGet, websocket: true, auth: "Bearer " + testToken}, true, http.StatusOK, servedFull},
+		{"invalid token", authRequest{method: http.MethodGet, websocket: true, auth: "Bearer other-token"}, true, http.StatusUnauthorized, ""},
+		// nothing is served without a token if every namespace has protected methods
+		{"no open namespaces", authRequest{method: http.MethodGet, websocket: true}, false, http.StatusUnauthorized, ""},
+	} {
+		status, served := serveAuth(t, conf, c.req, c.withOpen)
+		if status != c.status || served != c.served {
+			t.Errorf("%s: expected status %d served by %q, got status %d served by %q", c.name, c.status, c.served, status, served)
+		}
+	}
+}
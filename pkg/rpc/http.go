@@ -18,6 +18,8 @@ package rpc
 
 import (
 	"fmt"
+	"net/http"
+	"strings"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/node"
@@ -27,18 +29,60 @@ import (
 	"github.com/cerc-io/eth-statediff-service/pkg/prom"
 )
 
-// StartHTTPEndpoint starts the HTTP RPC endpoint, configured with cors/vhosts/modules.
-func StartHTTPEndpoint(endpoint string, apis []rpc.API, modules []string, cors []string, vhosts []string, timeouts rpc.HTTPTimeouts) (*rpc.Server, error) {
+// MaxRequestContentLength is the largest request body accepted by the go-ethereum RPC server
+const MaxRequestContentLength = 5 * 1024 * 1024
+
+// HTTPConfig configures the HTTP RPC endpoint
+type HTTPConfig struct {
+	Endpoint string
+	// API namespaces to serve; the public APIs are served if empty
+	Modules []string
+	// allowed CORS origins and virtual hosts
+	Cors   []string
+	Vhosts []string
+	// timeouts under one second are replaced by the go-ethereum defaults
+	Timeouts rpc.HTTPTimeouts
+	// maximum size of a request body in bytes, at most MaxRequestContentLength; unlimited if zero
+	MaxBodySize int64
+	// serve websocket connections on the same endpoint, accepting the CORS origins
+	WS bool
+	// token authentication, disabled if no secret or tokens are configured
+	Auth AuthConfig
+}
+
+// StartHTTPEndpoint starts the HTTP RPC endpoint, configured with cors/vhosts/modules, timeouts, body size limit
+// and authentication.
+func StartHTTPEndpoint(conf HTTPConfig, apis []rpc.API) (*rpc.Server, error) {
 
 	srv := rpc.NewServer()
+	modules := httpModules(conf, apis)
+	if len(modules) == 0 {
+		utils.Fatalf("No API namespaces to serve over HTTP")
+	}
+	// an empty module list would register every API
 	err := node.RegisterApis(apis, modules, srv)
 	if err != nil {
-		utils.Fatalf("Could not register HTTP API: %w", err)
+		utils.Fatalf("Could not register HTTP API: %v", err)
+	}
+	handler := rpcHandler(srv, conf)
+	if conf.Auth.Enabled() {
+		var open http.Handler
+		if conf.WS {
+			open = openHandler(conf, apis)
+		}
+		handler = newAuthHandler(conf.Auth, handler, open)
+		log.Infof("HTTP endpoint requires a token for %v", protectedNames(conf.Auth))
+	}
+	handler = node.NewHTTPHandlerStack(handler, conf.Cors, conf.Vhosts, nil)
+	if conf.MaxBodySize > MaxRequestContentLength {
+		log.Warnf("HTTP request bodies are limited to %d bytes by the RPC server", MaxRequestContentLength)
+	}
+	if conf.MaxBodySize > 0 {
+		handler = limitBodySize(handler, conf.MaxBodySize)
 	}
-	handler := node.NewHTTPHandlerStack(srv, cors, vhosts, nil)
 
 	// start http server
-	_, addr, err := node.StartHTTPEndpoint(endpoint, rpc.DefaultHTTPTimeouts, prom.HTTPMiddleware(handler))
+	_, addr, err := node.StartHTTPEndpoint(conf.Endpoint, conf.Timeouts, prom.HTTPMiddleware(handler))
 	if err != nil {
 		utils.Fatalf("Could not start RPC api: %v", err)
 	}
@@ -47,3 +91,72 @@ func StartHTTPEndpoint(endpoint string, apis []rpc.API, modules []string, cors [
 
 	return srv, err
 }
+
+// rpcHandler serves HTTP requests, and websocket connections if enabled, with the server
+func rpcHandler(srv *rpc.Server, conf HTTPConfig) http.Handler {
+	if !conf.WS {
+		return srv
+	}
+	ws := srv.WebsocketHandler(conf.Cors)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isWebsocket(r) {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		srv.ServeHTTP(w, r)
+	})
+}
+
+// httpModules returns the namespaces served over HTTP: the configured modules, or else the public APIs.
+// Non-public APIs such as admin are only served if listed explicitly.
+func httpModules(conf HTTPConfig, apis []rpc.API) []string {
+	if len(conf.Modules) > 0 {
+		return conf.Modules
+	}
+	var modules []string
+	for _, api := range apis {
+		if api.Public {
+			modules = append(modules, api.Namespace)
+		}
+	}
+	return modules
+}
+
+// openHandler serves the namespaces without protected methods to unauthenticated websocket connections,
+// returning nil if there are none
+func openHandler(conf HTTPConfig, apis []rpc.API) http.Handler {
+	var modules []string
+	for _, m := range httpModules(conf, apis) {
+		if !conf.Auth.protectsAny(m) {
+			modules = append(modules, m)
+		}
+	}
+	if len(modules) == 0 {
+		return nil
+	}
+	srv := rpc.NewServer()
+	if err := node.RegisterApis(apis, modules, srv); err != nil {
+		utils.Fatalf("Could not register HTTP API: %v", err)
+	}
+	return srv.WebsocketHandler(conf.Cors)
+}
+
+// protectedNames describes what requires a token
+func protectedNames(conf AuthConfig) string {
+	if len(conf.Protected) == 0 {
+		return "all methods"
+	}
+	return strings.Join(conf.Protected, ", ")
+}
+
+// limitBodySize rejects requests with a body larger than max
+func limitBodySize(next http.Handler, max int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			http.Error(w, fmt.Sprintf("content length too large (%d>%d)", r.ContentLength, max), http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		next.ServeHTTP(w, r)
+	})
+}
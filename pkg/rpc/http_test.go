@@ -0,0 +1,50 @@
+// VulcanizeDB
+// Copyright © 2023 Vulcanize
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package rpc
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type testService struct{}
+
+func (testService) Ping() string { return "pong" }
+
+var testAPIs = []rpc.API{
+	{Namespace: "statediff", Service: testService{}, Public: true},
+	{Namespace: "admin", Service: testService{}, Public: false},
+}
+
+func TestHTTPModules(t *testing.T) {
+	for _, c := range []struct {
+		modules  []string
+		expected []string
+	}{
+		// admin is not public, so it is only served if listed
+		{nil, []string{"statediff"}},
+		{[]string{"statediff"}, []string{"statediff"}},
+		{[]string{"statediff", "admin"}, []string{"statediff", "admin"}},
+	} {
+		got := httpModules(HTTPConfig{Modules: c.modules}, testAPIs)
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("modules %v: expected %v, got %v", c.modules, c.expected, got)
+		}
+	}
+}
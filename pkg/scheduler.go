@@ -0,0 +1,472 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
+)
+
+const defaultBatchSize = 64
+
+// maximum number of failed heights recorded per job
+const maxFailedHeights = 1000
+
+// number of finished jobs whose metrics are kept
+const maxFinishedJobMetrics = 50
+
+// jobOptions controls how a range is scheduled
+type jobOptions struct {
+	// stop handing out batches of the job after the first failed block
+	failFast bool
+	// local jobs (preruns) are not subject to the queue limit
+	local bool
+	// the submitter waits for the job, which is not subject to the queue limit either
+	waited bool
+	// drop all queued jobs once the job fails, for runs which stop at the first error
+	haltOnError bool
+}
+
+// limited reports whether the job counts against the queue limit
+func (opts jobOptions) limited() bool {
+	return !opts.local && !opts.waited
+}
+
+// rangeJob is a range request which is processed by the workers in small batches
+type rangeJob struct {
+	RangeRequest
+	jobOptions
+	id uint64
+	// scheduling level of the job's priority class
+	level int
+	// highest block written so far
+	height atomic.Uint64
+	// span of the job, and a context carrying it for the spans of its batches
+	ctx  context.Context
+	span trace.Span
+	// output shared by the batches of the job, closed once the job is finished; may be nil
+	out *rangeOutput
+
+	// the following are guarded by the scheduler mutex
+
+	// next height to hand out
+	next uint64
+	// whether the job still has blocks to hand out
+	queued bool
+	// number of batches handed out but not yet finished
+	active                     int
+	processed, skipped, failed uint64
+	// heights of the failed blocks, up to maxFailedHeights
+	failedHeights []uint64
+	err           error
+	started       time.Time
+	// time the first batch was handed out
+	claimed time.Time
+	// closed once all batches of the job are finished
+	done chan struct{}
+}
+
+// batch is a contiguous part of a job claimed by a worker
+type batch struct {
+	RangeRequest
+	job *rangeJob
+}
+
+// scheduler hands out small batches of the queued jobs to workers on demand, by priority and then in
+// order of submission, so that idle workers keep picking up work until every job is done, however unevenly block cost is
+// distributed over a range.
+type scheduler struct {
+	batchSize uint64
+	// maximum number of queued jobs subject to the limit, unlimited if zero
+	maxQueued int
+
+	mtx   sync.Mutex
+	queue []*rangeJob
+	// number of queued jobs subject to the limit
+	numQueued int
+	lastID    uint64
+	closed    bool
+	paused    bool
+	// labels of the most recently finished jobs, whose metrics are kept
+	finished []string
+	// closed and replaced whenever work is added or the scheduler is closed
+	wake chan struct{}
+}
+
+func newScheduler(batchSize uint64, maxQueued int) *scheduler {
+	if batchSize == 0 {
+		batchSize = defaultBatchSize
+	}
+	return &scheduler{
+		batchSize: batchSize,
+		maxQueued: maxQueued,
+		wake:      make(chan struct{}),
+	}
+}
+
+// submit queues a job for the range, in the priority class set in its options. The job takes ownership
+// of out, if the job was queued. The job's span is started as a child of the span in ctx, if any.
+func (s *scheduler) submit(ctx context.Context, rng RangeRequest, opts jobOptions, out *rangeOutput) (*rangeJob, error) {
+	level, err := rng.Priority.level()
+	if err != nil {
+		return nil, fmt.Errorf("unable to add range (%d, %d): %w", rng.Start, rng.Stop, err)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.closed {
+		return nil, fmt.Errorf("unable to add range (%d, %d): scheduler is closed", rng.Start, rng.Stop)
+	}
+	if opts.limited() && s.maxQueued > 0 && s.numQueued >= s.maxQueued {
+		return nil, fmt.Errorf("unable to add range (%d, %d): %d ranges already queued", rng.Start, rng.Stop, s.numQueued)
+	}
+	s.lastID++
+	job := &rangeJob{
+		RangeRequest: rng,
+		jobOptions:   opts,
+		id:           s.lastID,
+		level:        level,
+		next:         rng.Start,
+		queued:       true,
+		out:          out,
+		started:      time.Now(),
+		done:         make(chan struct{}),
+	}
+	attrs := append(tracing.Range(rng.Start, rng.Stop),
+		attribute.Int64("job.id", int64(job.id)),
+		attribute.String("job.priority", string(rng.Priority)))
+	_, job.span = tracing.Start(ctx, "range job", attrs...)
+	// the job outlives the request it was submitted with, so only its span is kept
+	job.ctx = withLogFields(trace.ContextWithSpan(context.Background(), job.span),
+		logrus.Fields{fieldJob: job.id, fieldPriority: rng.Priority})
+	s.queue = append(s.queue, job)
+	if opts.limited() {
+		s.numQueued++
+	}
+	prom.IncQueuedRanges(string(rng.Priority))
+	prom.AddQueuedBlocks(string(rng.Priority), float64(rng.Stop-rng.Start+1))
+	s.signal()
+	return job, nil
+}
+
+// claim waits for the next batch of work in a priority class at or above minLevel. It returns false
+// once quit or retire is closed, or once the scheduler is closed and no such work is left.
+// No work is handed out while the scheduler is paused.
+func (s *scheduler) claim(quit, retire <-chan struct{}, minLevel int) (batch, bool) {
+	for {
+		s.mtx.Lock()
+		if !s.paused {
+			if job := s.nextJob(minLevel); job != nil {
+				b := s.nextBatch(job)
+				s.mtx.Unlock()
+				return b, true
+			}
+			if s.closed {
+				s.mtx.Unlock()
+				return batch{}, false
+			}
+		}
+		wake := s.wake
+		s.mtx.Unlock()
+
+		select {
+		case <-wake:
+		case <-quit:
+			return batch{}, false
+		case <-retire:
+			return batch{}, false
+		}
+	}
+}
+
+// setPaused stops or resumes handing out work; batches already handed out are not affected
+func (s *scheduler) setPaused(paused bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.paused = paused
+	s.signal()
+}
+
+// status returns the number of queued jobs and whether the scheduler is paused
+func (s *scheduler) status() (queued int, paused bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return len(s.queue), s.paused
+}
+
+// jobStatus describes the queued jobs, and the given jobs being processed, in order of submission
+func (s *scheduler) jobStatus(active []*rangeJob) []JobStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	jobs := make(map[uint64]*rangeJob)
+	for _, job := range append(active, s.queue...) {
+		jobs[job.id] = job
+	}
+	status := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		js := JobStatus{
+			ID:        job.id,
+			Start:     job.Start,
+			Stop:      job.Stop,
+			Priority:  job.Priority,
+			Queued:    job.queued,
+			Active:    job.active,
+			Processed: job.processed,
+			Skipped:   job.skipped,
+			Failed:    job.failed,
+			Started:   job.started,
+		}
+		if job.err != nil {
+			js.Error = job.err.Error()
+		}
+		status = append(status, js)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].ID < status[j].ID })
+	return status
+}
+
+// nextJob returns the first queued job of the highest priority class at or above minLevel;
+// the mutex must be held
+func (s *scheduler) nextJob(minLevel int) *rangeJob {
+	var job *rangeJob
+	for _, j := range s.queue {
+		if j.level >= minLevel && (job == nil || j.level > job.level) {
+			job = j
+		}
+	}
+	return job
+}
+
+// nextBatch hands out the next batch of the job; the mutex must be held
+func (s *scheduler) nextBatch(job *rangeJob) batch {
+	start := job.next
+	stop := job.Stop
+	if stop-start >= s.batchSize {
+		stop = start + s.batchSize - 1
+	}
+	job.active++
+	if job.claimed.IsZero() {
+		job.claimed = time.Now()
+	}
+	prom.AddQueuedBlocks(string(job.Priority), -float64(stop-start+1))
+	if stop == job.Stop {
+		s.dequeue(job)
+	} else {
+		job.next = stop + 1
+	}
+	rng := job.RangeRequest
+	rng.Start, rng.Stop = start, stop
+	return batch{RangeRequest: rng, job: job}
+}
+
+// finish records the result of a batch, and completes the job once its last batch is finished
+func (s *scheduler) finish(b batch, res rangeResult) {
+	s.mtx.Lock()
+	job := b.job
+	job.active--
+	job.processed += res.processed
+	job.skipped += res.skipped
+	job.failed += res.failed
+	for _, height := range res.failedHeights {
+		if len(job.failedHeights) == maxFailedHeights {
+			break
+		}
+		job.failedHeights = append(job.failedHeights, height)
+	}
+	halt := false
+	if res.err != nil && job.err == nil {
+		job.err = res.err
+		if job.failFast && job.queued {
+			logger(job.ctx).WithField(fieldEvent, eventRangeAborted).Errorf("aborting range (%d, %d): %v", job.Start, job.Stop, res.err)
+			prom.AddQueuedBlocks(string(job.Priority), -float64(job.Stop-job.next+1))
+			s.dequeue(job)
+		}
+		halt = job.haltOnError
+	}
+	if elapsed := time.Since(job.claimed).Seconds(); elapsed > 0 {
+		prom.SetJobBlockRate(job.label(), float64(job.processed)/elapsed)
+	}
+	finished := !job.queued && job.active == 0
+	s.mtx.Unlock()
+	if finished {
+		s.complete(job)
+	}
+	if halt {
+		s.abandon(fmt.Errorf("not processed after range (%d, %d) failed", job.Start, job.Stop))
+	}
+}
+
+// complete closes the output of a job which has no batches left, and marks the job as done
+func (s *scheduler) complete(job *rangeJob) {
+	// no batch uses the output anymore; it is closed outside the mutex as that writes the CAR file
+	var err error
+	if job.out != nil {
+		err = job.out.close(nil)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if err != nil {
+		logger(job.ctx).Errorf("error finishing range (%d, %d): %v", job.Start, job.Stop, err)
+		if job.err == nil {
+			job.err = err
+		}
+	}
+	logger(job.ctx).WithFields(logrus.Fields{
+		fieldEvent:    eventRangeFinished,
+		fieldStart:    job.Start,
+		fieldStop:     job.Stop,
+		fieldDuration: time.Since(job.started),
+		"processed":   job.processed,
+		"skipped":     job.skipped,
+		"failed":      job.failed,
+	}).Infof("Finished processing range (%d, %d)", job.Start, job.Stop)
+	s.retainJobMetrics(job.label())
+	job.span.SetAttributes(
+		attribute.Int64("job.processed", int64(job.processed)),
+		attribute.Int64("job.skipped", int64(job.skipped)),
+		attribute.Int64("job.failed", int64(job.failed)))
+	tracing.End(job.span, job.err)
+	close(job.done)
+}
+
+// retainJobMetrics keeps the metrics of a finished job, and removes those of the oldest finished job
+// beyond maxFinishedJobMetrics; the mutex must be held
+func (s *scheduler) retainJobMetrics(label string) {
+	s.finished = append(s.finished, label)
+	if len(s.finished) > maxFinishedJobMetrics {
+		prom.DeleteJobMetrics(s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+// cancel stops handing out the remaining blocks of the job, and completes it with err unless it has
+// batches in progress, which finish as usual. It returns false if the job was no longer queued.
+func (s *scheduler) cancel(job *rangeJob, err error) bool {
+	s.mtx.Lock()
+	if !job.queued {
+		s.mtx.Unlock()
+		return false
+	}
+	prom.AddQueuedBlocks(string(job.Priority), -float64(job.Stop-job.next+1))
+	s.dequeue(job)
+	if job.err == nil {
+		job.err = err
+	}
+	finished := job.active == 0
+	s.mtx.Unlock()
+	if finished {
+		s.complete(job)
+	}
+	return true
+}
+
+// abandon closes the scheduler and completes the jobs left in the queue with err. Jobs with batches in
+// progress are completed once those are finished.
+func (s *scheduler) abandon(err error) {
+	s.mtx.Lock()
+	s.closed = true
+	s.signal()
+	var jobs []*rangeJob
+	for len(s.queue) > 0 {
+		job := s.queue[0]
+		prom.AddQueuedBlocks(string(job.Priority), -float64(job.Stop-job.next+1))
+		s.dequeue(job)
+		if job.err == nil {
+			job.err = err
+		}
+		// jobs with batches in progress are completed when those finish
+		if job.active == 0 {
+			jobs = append(jobs, job)
+		}
+	}
+	s.mtx.Unlock()
+	for _, job := range jobs {
+		s.complete(job)
+	}
+}
+
+// dequeue removes the job from the queue; the mutex must be held
+func (s *scheduler) dequeue(job *rangeJob) {
+	for i, j := range s.queue {
+		if j == job {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			break
+		}
+	}
+	job.queued = false
+	if job.limited() {
+		s.numQueued--
+	}
+	prom.DecQueuedRanges(string(job.Priority))
+}
+
+// close lets workers exit once all queued work has been claimed
+func (s *scheduler) close() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.closed = true
+	s.signal()
+}
+
+// signal wakes up all waiting workers; the mutex must be held
+func (s *scheduler) signal() {
+	close(s.wake)
+	s.wake = make(chan struct{})
+}
+
+// logQueued logs that the job was added to the queue
+func (job *rangeJob) logQueued(kind string) {
+	logger(job.ctx).WithFields(logrus.Fields{
+		fieldEvent: eventRangeQueued,
+		fieldStart: job.Start,
+		fieldStop:  job.Stop,
+	}).Infof("Added %srange (%d, %d) to the worker queue", kind, job.Start, job.Stop)
+}
+
+// label identifies the job in metrics
+func (job *rangeJob) label() string {
+	return strconv.FormatUint(job.id, 10)
+}
+
+// observeHeight records a written block and returns the highest block written for the job
+func (job *rangeJob) observeHeight(number uint64) uint64 {
+	for {
+		height := job.height.Load()
+		if number <= height {
+			return height
+		}
+		if job.height.CompareAndSwap(height, number) {
+			return number
+		}
+	}
+}
+
+// wait blocks until the job is finished and returns its first error
+func (job *rangeJob) wait() error {
+	<-job.done
+	return job.err
+}
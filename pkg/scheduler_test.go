@@ -0,0 +1,361 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	sd "github.com/cerc-io/plugeth-statediff"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/car"
+)
+
+// how long a claim is given to show that it is blocked
+const blockedClaimWait = 50 * time.Millisecond
+
+func testRange(start, stop uint64, priority Priority) RangeRequest {
+	return RangeRequest{Start: start, Stop: stop, RangeOptions: RangeOptions{Priority: priority}}
+}
+
+func mustSubmit(t *testing.T, s *scheduler, rng RangeRequest, opts jobOptions, out *rangeOutput) *rangeJob {
+	t.Helper()
+	job, err := s.submit(context.Background(), rng, opts, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+// mustClaim claims the next batch, failing if none is available
+func mustClaim(t *testing.T, s *scheduler, minLevel int) batch {
+	t.Helper()
+	retire := make(chan struct{})
+	timer := time.AfterFunc(time.Second, func() { close(retire) })
+	defer timer.Stop()
+	b, ok := s.claim(nil, retire, minLevel)
+	if !ok {
+		t.Fatal("expected a batch to be claimed")
+	}
+	return b
+}
+
+// claimAsync claims the next batch in the background, until retire is closed
+func claimAsync(s *scheduler, minLevel int, retire <-chan struct{}) <-chan batch {
+	claimed := make(chan batch, 1)
+	go func() {
+		if b, ok := s.claim(nil, retire, minLevel); ok {
+			claimed <- b
+		}
+		close(claimed)
+	}()
+	return claimed
+}
+
+func assertBatch(t *testing.T, b batch, start, stop uint64) {
+	t.Helper()
+	if b.Start != start || b.Stop != stop {
+		t.Fatalf("expected batch (%d, %d), got (%d, %d)", start, stop, b.Start, b.Stop)
+	}
+}
+
+func isDone(job *rangeJob) bool {
+	select {
+	case <-job.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	s := newScheduler(2, 0)
+	mustSubmit(t, s, testRange(0, 3, PriorityBulk), jobOptions{}, nil)
+	mustSubmit(t, s, testRange(10, 11, PriorityNormal), jobOptions{}, nil)
+	mustSubmit(t, s, testRange(20, 20, PriorityInteractive), jobOptions{}, nil)
+	mustSubmit(t, s, testRange(30, 31, PriorityNormal), jobOptions{}, nil)
+
+	// highest class first, then in order of submission
+	for _, want := range [][2]uint64{{20, 20}, {10, 11}, {30, 31}, {0, 1}, {2, 3}} {
+		assertBatch(t, mustClaim(t, s, 0), want[0], want[1])
+	}
+}
+
+func TestSchedulerInteractiveWorkers(t *testing.T) {
+	s := newScheduler(2, 0)
+	interactive, _ := PriorityInteractive.level()
+	mustSubmit(t, s, testRange(0, 3, PriorityNormal), jobOptions{}, nil)
+
+	// workers reserved for interactive requests don't pick up other work
+	retire := make(chan struct{})
+	claimed := claimAsync(s, interactive, retire)
+	select {
+	case <-claimed:
+		t.Fatal("interactive worker claimed a normal batch")
+	case <-time.After(blockedClaimWait):
+	}
+	mustSubmit(t, s, testRange(5, 5, PriorityInteractive), jobOptions{}, nil)
+	select {
+	case b := <-claimed:
+		assertBatch(t, b, 5, 5)
+	case <-time.After(time.Second):
+		t.Fatal("interactive worker did not claim the interactive batch")
+	}
+	close(retire)
+}
+
+func TestSchedulerPause(t *testing.T) {
+	s := newScheduler(2, 0)
+	s.setPaused(true)
+	mustSubmit(t, s, testRange(0, 1, PriorityNormal), jobOptions{}, nil)
+	if queued, paused := s.status(); queued != 1 || !paused {
+		t.Fatalf("expected 1 queued range while paused, got %d, %v", queued, paused)
+	}
+
+	retire := make(chan struct{})
+	defer close(retire)
+	claimed := claimAsync(s, 0, retire)
+	select {
+	case <-claimed:
+		t.Fatal("work was handed out while paused")
+	case <-time.After(blockedClaimWait):
+	}
+	s.setPaused(false)
+	select {
+	case b := <-claimed:
+		assertBatch(t, b, 0, 1)
+	case <-time.After(time.Second):
+		t.Fatal("work was not handed out after resuming")
+	}
+}
+
+func TestSchedulerFailFast(t *testing.T) {
+	s := newScheduler(2, 0)
+	job := mustSubmit(t, s, testRange(0, 5, PriorityNormal), jobOptions{failFast: true}, nil)
+	first := mustClaim(t, s, 0)
+	second := mustClaim(t, s, 0)
+
+	failure := errors.New("block failed")
+	s.finish(first, rangeResult{processed: 1, failed: 1, failedHeights: []uint64{1}, err: failure})
+	if queued, _ := s.status(); queued != 0 {
+		t.Fatalf("expected the failed job to be dequeued, %d ranges are queued", queued)
+	}
+	if isDone(job) {
+		t.Fatal("job finished while a batch was still in progress")
+	}
+	s.finish(second, rangeResult{processed: 2})
+	if !isDone(job) {
+		t.Fatal("job did not finish after its last batch")
+	}
+	if !errors.Is(job.wait(), failure) {
+		t.Errorf("expected the first failure, got %v", job.err)
+	}
+	if job.processed != 3 || job.failed != 1 || len(job.failedHeights) != 1 {
+		t.Errorf("unexpected counts: processed %d, failed %d at %v", job.processed, job.failed, job.failedHeights)
+	}
+}
+
+func TestSchedulerContinueOnError(t *testing.T) {
+	s := newScheduler(2, 0)
+	job := mustSubmit(t, s, testRange(0, 3, PriorityNormal), jobOptions{}, nil)
+	s.finish(mustClaim(t, s, 0), rangeResult{failed: 2, err: errors.New("block failed")})
+	// the rest of the range is still handed out
+	b := mustClaim(t, s, 0)
+	assertBatch(t, b, 2, 3)
+	s.finish(b, rangeResult{processed: 2})
+	if !isDone(job) || job.err == nil || job.processed != 2 || job.failed != 2 {
+		t.Errorf("unexpected job result: done %v, err %v, processed %d, failed %d", isDone(job), job.err, job.processed, job.failed)
+	}
+}
+
+func TestSchedulerQueueLimit(t *testing.T) {
+	s := newScheduler(2, 1)
+	mustSubmit(t, s, testRange(0, 1, PriorityNormal), jobOptions{}, nil)
+	if _, err := s.submit(context.Background(), testRange(2, 3, PriorityNormal), jobOptions{}, nil); err == nil {
+		t.Fatal("expected the queue limit to be enforced")
+	}
+	// preruns are not limited
+	mustSubmit(t, s, testRange(4, 5, PriorityBulk), jobOptions{local: true}, nil)
+	// a job stops counting against the limit once all of its batches are handed out
+	mustClaim(t, s, 0)
+	mustSubmit(t, s, testRange(2, 3, PriorityNormal), jobOptions{}, nil)
+}
+
+func TestSchedulerClose(t *testing.T) {
+	s := newScheduler(2, 0)
+	mustSubmit(t, s, testRange(0, 1, PriorityNormal), jobOptions{}, nil)
+	s.close()
+	// queued work is still handed out after closing, then workers are released
+	mustClaim(t, s, 0)
+	if _, ok := s.claim(nil, nil, 0); ok {
+		t.Fatal("expected no more work after closing")
+	}
+	if _, err := s.submit(context.Background(), testRange(2, 3, PriorityNormal), jobOptions{}, nil); err == nil {
+		t.Fatal("expected submitting to a closed scheduler to fail")
+	}
+}
+
+func TestSchedulerFinishedJobMetrics(t *testing.T) {
+	s := newScheduler(2, 0)
+	var jobs []*rangeJob
+	for i := 0; i < maxFinishedJobMetrics+2; i++ {
+		jobs = append(jobs, mustSubmit(t, s, testRange(0, 1, PriorityNormal), jobOptions{}, nil))
+		s.finish(mustClaim(t, s, 0), rangeResult{processed: 2})
+	}
+	// the metrics of the oldest jobs are removed once enough jobs have finished after them
+	if len(s.finished) != maxFinishedJobMetrics || s.finished[0] != jobs[2].label() {
+		t.Errorf("expected the metrics of the last %d jobs to be kept, got %d starting at job %s",
+			maxFinishedJobMetrics, len(s.finished), s.finished[0])
+	}
+}
+
+// carOutput returns a range output writing a CAR file into dir
+func carOutput(t *testing.T, dir string) *rangeOutput {
+	w, err := car.NewWriter(filepath.Join(dir, "range.car"), car.V1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &rangeOutput{car: w}
+}
+
+func dirEntries(t *testing.T, dir string) int {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestSchedulerJobOutput(t *testing.T) {
+	dir := t.TempDir()
+	s := newScheduler(2, 0)
+	job := mustSubmit(t, s, testRange(0, 3, PriorityNormal), jobOptions{}, carOutput(t, dir))
+	first := mustClaim(t, s, 0)
+	second := mustClaim(t, s, 0)
+	if first.job.out != job.out || second.job.out != job.out {
+		t.Fatal("batches of a job must share its output")
+	}
+
+	s.finish(second, rangeResult{processed: 2})
+	// the writer's spool is still open
+	if dirEntries(t, dir) != 1 {
+		t.Fatal("output was closed before the last batch finished")
+	}
+	s.finish(first, rangeResult{processed: 2})
+	if !isDone(job) {
+		t.Fatal("job did not finish")
+	}
+	// nothing was committed, so the spool is removed and no CAR file is written
+	if n := dirEntries(t, dir); n != 0 {
+		t.Fatalf("expected the output to be closed, %d files left", n)
+	}
+}
+
+func TestSchedulerAbandon(t *testing.T) {
+	dir := t.TempDir()
+	s := newScheduler(2, 0)
+	active := mustSubmit(t, s, testRange(0, 3, PriorityNormal), jobOptions{}, nil)
+	queued := mustSubmit(t, s, testRange(10, 11, PriorityNormal), jobOptions{}, carOutput(t, dir))
+	b := mustClaim(t, s, 0)
+
+	stopped := errors.New("stopped")
+	s.abandon(stopped)
+	if !isDone(queued) || !errors.Is(queued.err, stopped) {
+		t.Fatalf("expected the queued job to be finished with the error, got done %v, err %v", isDone(queued), queued.err)
+	}
+	if n := dirEntries(t, dir); n != 0 {
+		t.Fatalf("expected the output of the queued job to be closed, %d files left", n)
+	}
+	// a job with a batch in progress finishes with that batch
+	if isDone(active) {
+		t.Fatal("job finished while a batch was in progress")
+	}
+	s.finish(b, rangeResult{processed: 2})
+	if !isDone(active) || !errors.Is(active.err, stopped) {
+		t.Errorf("expected the active job to be finished with the error, got done %v, err %v", isDone(active), active.err)
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	s := newScheduler(2, 1)
+	job := mustSubmit(t, s, testRange(0, 0, PriorityInteractive), jobOptions{failFast: true, waited: true}, nil)
+	// waited jobs are not subject to the queue limit
+	mustSubmit(t, s, testRange(10, 11, PriorityNormal), jobOptions{}, nil)
+	mustSubmit(t, s, testRange(1, 1, PriorityInteractive), jobOptions{waited: true}, nil)
+
+	if !s.cancel(job, context.Canceled) {
+		t.Fatal("expected the queued job to be cancelled")
+	}
+	if !isDone(job) || !errors.Is(job.err, context.Canceled) {
+		t.Fatalf("expected the job to be finished with the error, got done %v, err %v", isDone(job), job.err)
+	}
+	// the cancelled job is not handed out
+	assertBatch(t, mustClaim(t, s, 0), 1, 1)
+	if s.cancel(job, context.Canceled) {
+		t.Error("expected a finished job not to be cancelled again")
+	}
+
+	// a job in progress is left to its worker
+	b := mustClaim(t, s, 0)
+	if s.cancel(b.job, context.Canceled) || isDone(b.job) {
+		t.Fatal("expected a job in progress not to be cancelled")
+	}
+}
+
+func TestScheduleStateDiffAt(t *testing.T) {
+	newService := func(workers, interactiveWorkers uint) *Service {
+		return &Service{
+			sched:              newScheduler(2, 1),
+			workers:            workers,
+			interactiveWorkers: interactiveWorkers,
+			workerWg:           new(sync.WaitGroup),
+		}
+	}
+	ctx := context.Background()
+
+	sds := newService(0, 0)
+	if err := sds.ScheduleStateDiffAt(ctx, 1, sd.Params{}, PriorityInteractive); err == nil {
+		t.Error("expected an error without workers")
+	}
+	sds = newService(0, 1)
+	if err := sds.ScheduleStateDiffAt(ctx, 1, sd.Params{}, PriorityNormal); err == nil {
+		t.Error("expected an error without workers for the normal class")
+	}
+	sds = newService(1, 0)
+	sds.sched.setPaused(true)
+	if err := sds.ScheduleStateDiffAt(ctx, 1, sd.Params{}, ""); err == nil {
+		t.Error("expected an error while paused")
+	}
+	if queued, _ := sds.sched.status(); queued != 0 {
+		t.Fatalf("expected nothing to be queued, got %d ranges", queued)
+	}
+
+	// no worker is actually running, so the request times out and is dequeued
+	sds.sched.setPaused(false)
+	ctx, cancel := context.WithTimeout(ctx, blockedClaimWait)
+	defer cancel()
+	if err := sds.ScheduleStateDiffAt(ctx, 1, sd.Params{}, ""); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+	if queued, _ := sds.sched.status(); queued != 0 {
+		t.Errorf("expected the block to be removed from the queue, %d ranges are queued", queued)
+	}
+}
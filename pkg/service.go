@@ -17,9 +17,12 @@ package statediff
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"math/big"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cerc-io/plugeth-statediff"
@@ -31,46 +34,117 @@ import (
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/ipfs/go-cid"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"github.com/cerc-io/eth-statediff-service/pkg/car"
 	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
 )
 
 const defaultQueueSize = 1024
 
 // Service is the underlying struct for the state diffing service
 type Service struct {
-	// Used to build the state diff objects
-	builder statediff.Builder
+	// Used to build the state diff objects, replaced when the number of trie workers changes
+	builder     statediff.Builder
+	trieWorkers uint
+	builderMtx  sync.RWMutex
 	// Used to read data from LevelDB
 	lvlDBReader Reader
-	// Used to signal shutdown of the service
+	// Used to signal shutdown of the service, closed once by Stop
 	quitChan chan struct{}
+	stopOnce sync.Once
+	// set once Run or Loop has started the workers
+	started atomic.Bool
 	// Interface for publishing statediffs as PG-IPLD objects
 	indexer interfaces.StateDiffIndexer
-	// range queue
-	queue chan RangeRequest
+	// schedules the queued ranges over the workers
+	sched *scheduler
+	// number of additional workers which only process interactive requests
+	interactiveWorkers uint
 	// number of ranges we can work over concurrently
 	workers uint
+	// running service workers, each retired by closing its channel
+	workersMtx sync.Mutex
+	workerWg   *sync.WaitGroup
+	retire     []chan struct{}
+	// progress of the running workers by ID
+	progress map[int]*workerProgress
 	// ranges configured locally
 	preruns []RangeRequest
+	// records fully written blocks, may be nil
+	marker CompletionMarker
+	// directory for CAR files, CAR output is disabled if empty
+	carDir       string
+	carVersion   int
+	carOverwrite bool
+	// limits the open indexer transactions to the database connection pool, may be nil
+	txSlots txSlots
+	// maximum number of blocks queued between pipeline stages
+	pipelineDepth uint
+	// maximum number of trie nodes prefetched per block, prefetching is disabled if zero
+	prefetchNodes uint
+	// limits database writes while commit latency is high, may be nil
+	throttle *throttle
+	// limits the blocks in processing to the memory budget, may be nil
+	memory *memoryGovernor
+	// timings of the most recently written blocks, may be nil
+	timings *timingHistory
+	// readiness and liveness checks
+	health HealthConfig
+	checks healthChecks
+	// most recent failed blocks, for the status page
+	failures failureLog
 }
 
 // NewStateDiffService creates a new Service
 func NewStateDiffService(lvlDBReader Reader, indexer interfaces.StateDiffIndexer, conf ServiceConfig) *Service {
 	builder := statediff.NewBuilder(adapt.GethStateView(lvlDBReader.StateDB()))
 	builder.SetSubtrieWorkers(conf.TrieWorkers)
+	prom.SetTrieWorkers(int(conf.TrieWorkers))
 	if conf.WorkerQueueSize == 0 {
 		conf.WorkerQueueSize = defaultQueueSize
 	}
-	return &Service{
-		lvlDBReader: lvlDBReader,
-		builder:     builder,
-		indexer:     indexer,
-		workers:     conf.ServiceWorkers,
-		queue:       make(chan RangeRequest, conf.WorkerQueueSize),
-		preruns:     conf.PreRuns,
-	}
+	if conf.PipelineDepth == 0 {
+		conf.PipelineDepth = defaultPipelineDepth
+	}
+	sds := &Service{
+		lvlDBReader:  lvlDBReader,
+		quitChan:     make(chan struct{}),
+		builder:      builder,
+		trieWorkers:  conf.TrieWorkers,
+		indexer:      indexer,
+		workers:      conf.ServiceWorkers,
+		sched:        newScheduler(conf.BatchSize, int(conf.WorkerQueueSize)),
+		preruns:      conf.PreRuns,
+		marker:       conf.CompletionMarker,
+		carDir:       conf.CarDir,
+		carVersion:   conf.CarVersion,
+		carOverwrite: conf.CarOverwrite,
+
+		interactiveWorkers: conf.InteractiveWorkers,
+		txSlots:            newTxSlots(conf.MaxOpenTxs),
+		pipelineDepth:      conf.PipelineDepth,
+		prefetchNodes:      conf.PrefetchNodes,
+		memory:             newMemoryGovernor(conf.Memory),
+		timings:            newTimingHistory(conf.Timings),
+		health:             conf.Health,
+	}
+	// each worker can have a block in the diff stage, pipelineDepth blocks queued for the commit stage
+	// and a block being committed, but no more blocks than there are transaction slots
+	sds.throttle = newThrottle(conf.Throttle, func() int {
+		sds.workersMtx.Lock()
+		defer sds.workersMtx.Unlock()
+		limit := int(sds.workers+sds.interactiveWorkers) * int(sds.pipelineDepth+2)
+		if sds.txSlots != nil && cap(sds.txSlots) < limit {
+			limit = cap(sds.txSlots)
+		}
+		return limit
+	})
+	return sds
 }
 
 // Protocols exports the services p2p protocols, this service has none
@@ -87,138 +161,120 @@ func (sds *Service) APIs() []rpc.API {
 			Service:   NewPublicStateDiffAPI(sds),
 			Public:    true,
 		},
+		{
+			Namespace: AdminAPIName,
+			Version:   APIVersion,
+			Service:   NewAdminAPI(sds),
+			Public:    false,
+		},
 	}
 }
 
-func segmentRange(workers, start, stop uint64, params statediff.Params) []RangeRequest {
-	segmentSize := ((stop - start) + 1) / workers
-	remainder := ((stop - start) + 1) % workers
-	numOfSegments := workers
-	if remainder > 0 {
-		numOfSegments++
-	}
-	segments := make([]RangeRequest, numOfSegments)
-	for i := range segments {
-		end := start + segmentSize - 1
-		if end > stop {
-			end = stop
-		}
-		segments[i] = RangeRequest{start, end, params}
-		start = end + 1
+// Run does a one-off processing run on the provided RangeRequests + any pre-runs, exiting afterwards.
+// If parallel is false the ranges are processed in order by a single worker, stopping at the first error.
+// The run can be interrupted with Stop, in which case the blocks already being processed are finished.
+// Once the ranges have been processed a report of the run is returned, along with any error.
+func (sds *Service) Run(rngs []RangeRequest, parallel bool) (*RunReport, error) {
+	if !sds.started.CompareAndSwap(false, true) {
+		return nil, fmt.Errorf("service loop is already running")
 	}
-	return segments
-}
+	started := time.Now()
+	go sds.throttle.run(sds.quitChan)
 
-// Run does a one-off processing run on the provided RangeRequests + any pre-runs, exiting afterwards
-func (sds *Service) Run(rngs []RangeRequest, parallel bool) error {
-	for _, preRun := range sds.preruns {
-		// if the rangeSize is smaller than the number of workers
-		// make sure we do synchronous processing to avoid quantization issues
-		rangeSize := (preRun.Stop - preRun.Start) + 1
-		numWorkers := uint64(sds.workers)
-		if rangeSize < numWorkers {
-			parallel = false
-		}
-		if parallel {
-			logrus.Infof("parallel processing prerun range (%d, %d) (%d blocks) divided into %d sized chunks with %d workers", preRun.Start, preRun.Stop,
-				rangeSize, rangeSize/numWorkers, numWorkers)
-			workChan := make(chan RangeRequest)
-			quitChan := make(chan struct{})
-			// spin up numWorkers number of worker goroutines
-			wg := new(sync.WaitGroup)
-			for i := 0; i < int(numWorkers); i++ {
-				wg.Add(1)
-				go func(id int) {
-					defer wg.Done()
-					for {
-						select {
-						case workerSegment := <-workChan:
-							for j := workerSegment.Start; j <= workerSegment.Stop; j++ {
-								if err := sds.WriteStateDiffAt(j, workerSegment.Params); err != nil {
-									logrus.Errorf("error writing statediff at height %d in range (%d, %d) : %v", id, workerSegment.Start, workerSegment.Stop, err)
-								}
-							}
-							logrus.Infof("prerun worker %d finished processing range (%d, %d)", id, workerSegment.Start, workerSegment.Stop)
-						case <-quitChan:
-							return
-						}
-					}
-				}(i)
-			}
-			// break range up into segments
-			segments := segmentRange(numWorkers, preRun.Start, preRun.Stop, preRun.Params)
-			// send the segments to the work channel
-			for _, segment := range segments {
-				workChan <- segment
-			}
-			close(quitChan)
-			wg.Wait()
-		} else {
-			logrus.Infof("sequential processing prerun range (%d, %d)", preRun.Start, preRun.Stop)
-			for i := preRun.Start; i <= preRun.Stop; i++ {
-				if err := sds.WriteStateDiffAt(i, preRun.Params); err != nil {
-					return fmt.Errorf("error writing statediff at height %d in range (%d, %d) : %v", i, preRun.Start, preRun.Stop, err)
-				}
-			}
-		}
+	workers := int(sds.workers)
+	if !parallel {
+		workers = 1
+	}
+	// the ranges of a run share one priority class, so they are processed in order: pre-runs first. Errors in
+	// parallel preruns are logged and the remaining blocks processed, a sequential run stops at the first error.
+	jobs, err := sds.submitPreRuns(PriorityNormal, jobOptions{failFast: !parallel, haltOnError: !parallel, local: true})
+	if err != nil {
+		return nil, err
 	}
-	sds.preruns = nil
-	// At present this code is never called so we have not written the parallel version:
 	for _, rng := range rngs {
-		logrus.Infof("processing requested range (%d, %d)", rng.Start, rng.Stop)
-		for i := rng.Start; i <= rng.Stop; i++ {
-			if err := sds.WriteStateDiffAt(i, rng.Params); err != nil {
-				return fmt.Errorf("error writing statediff at height %d in range (%d, %d) : %v", i, rng.Start, rng.Stop, err)
-			}
+		rng.Priority = PriorityNormal
+		job, err := sds.submitRange(context.Background(), rng, jobOptions{failFast: true, haltOnError: !parallel, local: true})
+		if err != nil {
+			return nil, err
 		}
+		job.logQueued("requested ")
+		jobs = append(jobs, job)
 	}
-	return nil
+	sds.sched.close()
+
+	logrus.Infof("processing %d ranges with %d workers", len(jobs), workers)
+	wg := new(sync.WaitGroup)
+	sds.startWorkers(wg, workers)
+	wg.Wait()
+	report := newRunReport(started, jobs)
+	select {
+	case <-sds.quitChan:
+		report.Interrupted = true
+		return report.failed(fmt.Errorf("processing was interrupted"))
+	default:
+	}
+	for _, job := range jobs {
+		if err := job.wait(); err != nil && job.failFast {
+			return report.failed(err)
+		}
+	}
+	return report, nil
 }
 
-// Loop is an empty service loop for awaiting rpc requests
+// submitRange queues a job for the range, with the output all batches of the range are written to
+func (sds *Service) submitRange(ctx context.Context, rng RangeRequest, opts jobOptions) (*rangeJob, error) {
+	out, err := sds.newRangeOutput(rng.Start, rng.Stop)
+	if err != nil {
+		return nil, fmt.Errorf("unable to add range (%d, %d): %w", rng.Start, rng.Stop, err)
+	}
+	job, err := sds.sched.submit(ctx, rng, opts, out)
+	if err != nil {
+		out.close(nil)
+		return nil, err
+	}
+	return job, nil
+}
+
+// Loop starts the service workers, which process the pre-runs and then await rpc requests
 func (sds *Service) Loop(wg *sync.WaitGroup) error {
-	if sds.quitChan != nil {
+	if !sds.started.CompareAndSwap(false, true) {
 		return fmt.Errorf("service loop is already running")
 	}
+	go sds.throttle.run(sds.quitChan)
+	sds.startWorkers(wg, int(sds.workers))
+	if _, err := sds.submitPreRuns("", jobOptions{local: true}); err != nil {
+		sds.Stop()
+		return err
+	}
+	return nil
+}
 
-	sds.quitChan = make(chan struct{})
-	for i := 0; i < int(sds.workers); i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			for {
-				select {
-				case blockRange := <-sds.queue:
-					log := logrus.WithField("range", blockRange).WithField("worker", id)
-					log.Debug("processing range")
-					prom.DecQueuedRanges()
-					for j := blockRange.Start; j <= blockRange.Stop; j++ {
-						if err := sds.WriteStateDiffAt(j, blockRange.Params); err != nil {
-							log.Errorf("error writing statediff at block %d: %v", j, err)
-						}
-						select {
-						case <-sds.quitChan:
-							log.Infof("closing service worker (last processed block: %d)", j)
-							return
-						default:
-							log.Infof("Finished processing block %d", j)
-						}
-					}
-					log.Debugf("Finished processing range")
-				case <-sds.quitChan:
-					logrus.Debugf("closing the statediff service loop worker %d", id)
-					return
-				}
-			}
-		}(i)
+// withPriority sets the priority class of the range if none was requested
+func withPriority(rng RangeRequest, priority Priority) RangeRequest {
+	if rng.Priority == "" {
+		rng.Priority = priority
 	}
+	return rng
+}
+
+// submitPreRuns adds the configured pre-runs to the worker queue, in the given priority class if set and
+// otherwise in their configured one
+func (sds *Service) submitPreRuns(priority Priority, opts jobOptions) ([]*rangeJob, error) {
+	var jobs []*rangeJob
 	for _, preRun := range sds.preruns {
-		if err := sds.WriteStateDiffsInRange(preRun.Start, preRun.Stop, preRun.Params); err != nil {
-			close(sds.quitChan)
-			return err
+		preRun = withPriority(preRun, PriorityBulk)
+		if priority != "" {
+			preRun.Priority = priority
 		}
+		job, err := sds.submitRange(context.Background(), preRun, opts)
+		if err != nil {
+			return nil, err
+		}
+		job.logQueued("prerun ")
+		jobs = append(jobs, job)
 	}
-	return nil
+	sds.preruns = nil
+	return jobs, nil
 }
 
 // StateDiffAt returns a state diff object payload at the specific blockheight
@@ -267,14 +323,14 @@ func (sds *Service) StateDiffFor(blockHash common.Hash, params statediff.Params)
 
 // processStateDiff method builds the state diff payload from the current block, parent state root, and provided params
 func (sds *Service) processStateDiff(currentBlock *types.Block, parentRoot common.Hash, params statediff.Params) (*statediff.Payload, error) {
-	stateDiff, err := sds.builder.BuildStateDiffObject(statediff.Args{
+	stateDiff, err := sds.getBuilder().BuildStateDiffObject(statediff.Args{
 		BlockHash:    currentBlock.Hash(),
 		BlockNumber:  currentBlock.Number(),
 		OldStateRoot: parentRoot,
 		NewStateRoot: currentBlock.Root(),
 	}, params)
 	if err != nil {
-		return nil, err
+		return nil, wrapError(ErrStateUnavailable, err)
 	}
 	stateDiffRlp, err := rlp.EncodeToBytes(&stateDiff)
 	if err != nil {
@@ -322,130 +378,380 @@ func (sds *Service) Start() error {
 	return sds.Loop(new(sync.WaitGroup))
 }
 
-// Stop is used to close down the service
+// Stop is used to close down the service. It may be called more than once, and before the service was started.
 func (sds *Service) Stop() error {
-	logrus.Info("stopping statediff service")
-	close(sds.quitChan)
+	sds.stopOnce.Do(func() {
+		logrus.Info("stopping statediff service")
+		close(sds.quitChan)
+	})
+	return nil
+}
+
+// Close releases the resources of the service once its workers have exited.
+// Ranges which were not finished are dropped, with the blocks written so far kept in their CAR files.
+func (sds *Service) Close() error {
+	sds.sched.abandon(errors.New("service was stopped"))
+	if sds.marker != nil {
+		return sds.marker.Close()
+	}
 	return nil
 }
 
 // WriteStateDiffAt writes a state diff at the specific blockheight directly to the database
 // This operation cannot be performed back past the point of db pruning; it requires an archival node
 // for historical data
-func (sds *Service) WriteStateDiffAt(blockNumber uint64, params statediff.Params) error {
-	logrus.Infof("Writing state diff at block %d", blockNumber)
-	t := time.Now()
-	currentBlock, err := sds.lvlDBReader.GetBlockByNumber(blockNumber)
+func (sds *Service) WriteStateDiffAt(blockNumber uint64, params statediff.Params) (err error) {
+	ctx, span := tracing.Start(context.Background(), "block")
+	ctx = withLogFields(ctx, logrus.Fields{fieldBlock: blockNumber})
+	defer func() {
+		recordError(err)
+		tracing.End(span, err)
+	}()
+	out, err := sds.newRangeOutput(blockNumber, blockNumber)
+	if err != nil {
+		return err
+	}
+	defer func() { err = out.close(err) }()
+	return sds.writeStateDiffAt(ctx, blockNumber, params, out)
+}
+
+// ScheduleStateDiffAt queues writing the state diff at the specific blockheight in the given priority class,
+// and waits for it to be written. It fails right away if no worker would pick up the block, and the block
+// is removed from the queue again if ctx is done before a worker started on it.
+func (sds *Service) ScheduleStateDiffAt(ctx context.Context, blockNumber uint64, params statediff.Params, priority Priority) error {
+	rng := withPriority(RangeRequest{Start: blockNumber, Stop: blockNumber, Params: params, RangeOptions: RangeOptions{Priority: priority}}, PriorityInteractive)
+	if err := sds.checkClaimable(rng.Priority); err != nil {
+		return fmt.Errorf("unable to write block %d: %w", blockNumber, err)
+	}
+	job, err := sds.submitRange(ctx, rng, jobOptions{failFast: true, waited: true})
+	if err != nil {
+		return err
+	}
+	select {
+	case <-job.done:
+		return job.err
+	case <-sds.quitChan:
+		return fmt.Errorf("service was stopped before block %d was written", blockNumber)
+	case <-ctx.Done():
+		if sds.sched.cancel(job, ctx.Err()) {
+			logger(job.ctx).Infof("Removed block %d from the worker queue: %v", blockNumber, ctx.Err())
+		}
+		return ctx.Err()
+	}
+}
+
+// checkClaimable returns an error if no worker currently picks up work of the priority class
+func (sds *Service) checkClaimable(priority Priority) error {
+	level, err := priority.level()
 	if err != nil {
 		return err
 	}
+	if _, paused := sds.sched.status(); paused {
+		return errors.New("processing is paused")
+	}
+	sds.workersMtx.Lock()
+	running, workers := sds.workerWg != nil, sds.workers
+	sds.workersMtx.Unlock()
+	if !running {
+		return errors.New("service workers are not running")
+	}
+	interactive, _ := PriorityInteractive.level()
+	if workers == 0 && (level < interactive || sds.interactiveWorkers == 0) {
+		return fmt.Errorf("no workers process %s requests", priority)
+	}
+	return nil
+}
 
+func (sds *Service) writeStateDiffAt(ctx context.Context, blockNumber uint64, params statediff.Params, out *rangeOutput) error {
 	// compute leaf paths of watched addresses in the params
 	params.ComputeWatchedAddressesLeafPaths()
 
-	parentRoot := common.Hash{}
-	if blockNumber != 0 {
-		parentBlock, err := sds.lvlDBReader.GetBlockByHash(currentBlock.ParentHash())
-		if err != nil {
-			return err
-		}
-		parentRoot = parentBlock.Root()
+	lb, err := sds.loadBlockAt(ctx, blockNumber, params)
+	if err != nil {
+		return err
 	}
-	return sds.writeStateDiff(currentBlock, parentRoot, params, t)
+	return sds.writeBlock(ctx, lb, out)
+}
+
+// writeBlock diffs and commits a single loaded block outside of the range pipeline. Like blocks in the
+// pipeline, it waits for memory and a throttle slot first.
+func (sds *Service) writeBlock(ctx context.Context, lb *loadedBlock, out *rangeOutput) error {
+	item := &stageItem{number: lb.block.NumberU64(), loaded: lb}
+	if !sds.admitBlock(item, sds.quitChan) {
+		return errPipelineStopped
+	}
+	defer sds.releaseBlock(item)
+	pending, err := sds.diffBlock(ctx, lb, out)
+	if err != nil {
+		return err
+	}
+	item.mem = sds.memory.observe(lb.block, pending.size, item.mem)
+	return out.commit(pending)
 }
 
 // WriteStateDiffFor writes a state diff for the specific blockHash directly to the database
 // This operation cannot be performed back past the point of db pruning; it requires an archival node
 // for historical data
-func (sds *Service) WriteStateDiffFor(blockHash common.Hash, params statediff.Params) error {
-	logrus.Infof("Writing state diff for block %s", blockHash)
+func (sds *Service) WriteStateDiffFor(blockHash common.Hash, params statediff.Params) (err error) {
 	t := time.Now()
-	currentBlock, err := sds.lvlDBReader.GetBlockByHash(blockHash)
+	ctx, span := tracing.Start(context.Background(), "block", attribute.String("block.hash", blockHash.Hex()))
+	ctx = withLogFields(ctx, logrus.Fields{fieldHash: blockHash})
+	logger(ctx).WithField(fieldEvent, eventBlockStarted).Infof("Writing state diff for block %s", blockHash)
+	defer func() {
+		recordError(err)
+		tracing.End(span, err)
+	}()
+	currentBlock, err := traceRead(ctx, "GetBlockByHash", func() (*types.Block, error) {
+		return sds.lvlDBReader.GetBlockByHash(blockHash)
+	})
+	if err != nil {
+		return err
+	}
+	out, err := sds.newRangeOutput(currentBlock.NumberU64(), currentBlock.NumberU64())
 	if err != nil {
 		return err
 	}
+	defer func() { err = out.close(err) }()
 
 	// compute leaf paths of watched addresses in the params
 	params.ComputeWatchedAddressesLeafPaths()
 
-	parentRoot := common.Hash{}
-	if currentBlock.NumberU64() != 0 {
-		parentBlock, err := sds.lvlDBReader.GetBlockByHash(currentBlock.ParentHash())
-		if err != nil {
-			return err
-		}
-		parentRoot = parentBlock.Root()
+	lb, err := sds.loadBlock(ctx, currentBlock, params, t)
+	if err != nil {
+		return err
 	}
-	return sds.writeStateDiff(currentBlock, parentRoot, params, t)
+	return sds.writeBlock(ctx, lb, out)
 }
 
-// Writes a state diff from the current block, parent state root, and provided params
-func (sds *Service) writeStateDiff(block *types.Block, parentRoot common.Hash, params statediff.Params, t time.Time) error {
-	var totalDifficulty *big.Int
-	var receipts types.Receipts
-	var err error
-	if params.IncludeTD {
-		totalDifficulty, err = sds.lvlDBReader.GetTdByHash(block.Hash())
+// checkSkip reports whether the block at the given height can be skipped according to the range options
+func (sds *Service) checkSkip(ctx context.Context, blockNumber uint64, opts RangeOptions) (bool, error) {
+	if !opts.SkipExisting {
+		return false, nil
 	}
-	if err != nil {
-		return err
+	complete, err := sds.isComplete(ctx, blockNumber)
+	if err != nil || !complete {
+		return false, err
 	}
-	if params.IncludeReceipts {
-		receipts, err = sds.lvlDBReader.GetReceiptsByHash(block.Hash())
+	logger(ctx).WithField(fieldEvent, eventBlockSkipped).Debugf("Skipping block %d: already complete", blockNumber)
+	prom.IncSkippedBlocks()
+	return true, nil
+}
+
+// isComplete checks the completion marker for the canonical block at the given height
+func (sds *Service) isComplete(ctx context.Context, blockNumber uint64) (bool, error) {
+	if sds.marker == nil {
+		return false, nil
 	}
+	hash, err := sds.lvlDBReader.GetCanonicalHash(blockNumber)
 	if err != nil {
-		return err
+		return false, err
+	}
+	return sds.marker.IsComplete(ctx, blockNumber, hash)
+}
+
+// loadedBlock holds everything read from LevelDB that is needed to diff a block
+type loadedBlock struct {
+	block           *types.Block
+	parentRoot      common.Hash
+	receipts        types.Receipts
+	totalDifficulty *big.Int
+	params          statediff.Params
+	timing          BlockTiming
+}
+
+// loadBlockAt reads the canonical block at the given height along with its parent root, receipts and TD
+func (sds *Service) loadBlockAt(ctx context.Context, blockNumber uint64, params statediff.Params) (*loadedBlock, error) {
+	logger(ctx).WithField(fieldEvent, eventBlockStarted).Infof("Writing state diff at block %d", blockNumber)
+	t := time.Now()
+	currentBlock, err := traceRead(ctx, "GetBlockByNumber", func() (*types.Block, error) {
+		return sds.lvlDBReader.GetBlockByNumber(blockNumber)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sds.loadBlock(ctx, currentBlock, params, t)
+}
+
+// loadBlock reads the parent root, receipts and TD for the block, as required by the params
+func (sds *Service) loadBlock(ctx context.Context, block *types.Block, params statediff.Params, t time.Time) (lb *loadedBlock, err error) {
+	trace.SpanFromContext(ctx).SetAttributes(tracing.Block(block.NumberU64(), block.Hash())...)
+	ctx, span := tracing.Start(ctx, "load")
+	defer func() { tracing.End(span, err) }()
+
+	lb = &loadedBlock{block: block, params: params}
+	if block.NumberU64() != 0 {
+		parentBlock, err := traceRead(ctx, "GetBlockByHash", func() (*types.Block, error) {
+			return sds.lvlDBReader.GetBlockByHash(block.ParentHash())
+		})
+		if err != nil {
+			return nil, err
+		}
+		lb.parentRoot = parentBlock.Root()
+	}
+	if params.IncludeTD {
+		lb.totalDifficulty, err = traceRead(ctx, "GetTdByHash", func() (*big.Int, error) {
+			return sds.lvlDBReader.GetTdByHash(block.Hash())
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if params.IncludeReceipts {
+		lb.receipts, err = traceRead(ctx, "GetReceiptsByHash", func() (types.Receipts, error) {
+			return sds.lvlDBReader.GetReceiptsByHash(block.Hash())
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	height := block.Number().Int64()
-	prom.SetLastLoadedHeight(height)
+	prom.SetLastLoadedHeight(block.Number().Int64())
 	prom.SetTimeMetric(prom.T_BLOCK_LOAD, time.Now().Sub(t))
-	t = time.Now()
-	tx, err := sds.indexer.PushBlock(block, receipts, totalDifficulty)
+	lb.timing = BlockTiming{Number: block.NumberU64(), Hash: block.Hash(), Load: time.Since(t)}
+	return lb, nil
+}
+
+// traceRead calls the Reader method in a span of the given name
+func traceRead[T any](ctx context.Context, method string, read func() (T, error)) (T, error) {
+	_, span := tracing.Start(ctx, "Reader."+method)
+	v, err := read()
+	tracing.End(span, err)
+	return v, err
+}
+
+// isCode reports whether the IPLD is a contract code blob, which unlike trie nodes is stored as raw binary
+func isCode(c sdtypes.IPLD) bool {
+	id, err := cid.Decode(c.CID)
+	return err == nil && id.Prefix().Codec == cid.Raw
+}
+
+// diffBlock pushes the loaded block and its state diff to the indexer, returning the uncommitted block.
+// It waits for a transaction slot before pushing the block; the caller is responsible for committing
+// (or rolling back) the returned block with out, which frees the slot.
+func (sds *Service) diffBlock(ctx context.Context, lb *loadedBlock, out *rangeOutput) (pb pendingBlock, err error) {
+	block := lb.block
+	timing := lb.timing
+	t := time.Now()
+	if err := sds.txSlots.acquire(ctx, sds.quitChan); err != nil {
+		return pb, err
+	}
+	_, span := tracing.Start(ctx, "PushBlock")
+	tx, err := sds.indexer.PushBlock(block, lb.receipts, lb.totalDifficulty)
+	tracing.End(span, err)
 	if err != nil {
-		return err
+		sds.txSlots.release()
+		return pb, wrapError(ErrIndexerWrite, err)
+	}
+	// defer handling of rollback for any error case, after which the caller owns the transaction
+	defer func() {
+		if err != nil {
+			out.rollback(pendingBlock{tx: tx}, err)
+		}
+	}()
+
+	// the block's CAR sections are only added to the file once it is committed
+	var carBlock *car.Block
+	if out.car != nil {
+		carBlock = new(car.Block)
+		if err = carBlock.PutBlock(block, lb.receipts); err != nil {
+			return pb, err
+		}
+	}
+	size := block.Size()
+	timing.Transactions = uint64(len(block.Transactions()))
+	timing.Receipts = uint64(len(lb.receipts))
+	for _, receipt := range lb.receipts {
+		timing.Logs += uint64(len(receipt.Logs))
 	}
-	// defer handling of commit/rollback for any return case
-	defer tx.RollbackOnFailure(err)
 
 	var nodeMtx, ipldMtx sync.Mutex
+	// set if an error came from the outputs rather than from reading the state
+	var outputFailed atomic.Bool
 	output := func(node sdtypes.StateLeafNode) error {
 		nodeMtx.Lock()
 		defer nodeMtx.Unlock()
-		return sds.indexer.PushStateNode(tx, node, block.Hash().String())
+		timing.StateNodes++
+		timing.StorageNodes += uint64(len(node.StorageDiff))
+		if node.Removed {
+			timing.RemovedNodes++
+		}
+		for _, storage := range node.StorageDiff {
+			if storage.Removed {
+				timing.RemovedNodes++
+			}
+		}
+		if err := sds.indexer.PushStateNode(tx, node, block.Hash().String()); err != nil {
+			outputFailed.Store(true)
+			return wrapError(ErrIndexerWrite, err)
+		}
+		return nil
 	}
 	ipldOutput := func(c sdtypes.IPLD) error {
 		ipldMtx.Lock()
 		defer ipldMtx.Unlock()
-		return sds.indexer.PushIPLD(tx, c)
+		if carBlock != nil {
+			if err := carBlock.PutIPLD(c.CID, c.Content); err != nil {
+				outputFailed.Store(true)
+				return err
+			}
+		}
+		size += uint64(len(c.Content))
+		timing.IPLDs++
+		if isCode(c) {
+			timing.Codes++
+		}
+		if err := sds.indexer.PushIPLD(tx, c); err != nil {
+			outputFailed.Store(true)
+			return wrapError(ErrIndexerWrite, err)
+		}
+		return nil
 	}
 	prom.SetTimeMetric(prom.T_BLOCK_PROCESSING, time.Now().Sub(t))
+	timing.BlockProcessing = time.Since(t)
 	t = time.Now()
-	err = sds.builder.WriteStateDiff(statediff.Args{
+	_, span = tracing.Start(ctx, "WriteStateDiff")
+	err = sds.getBuilder().WriteStateDiff(statediff.Args{
 		NewStateRoot: block.Root(),
-		OldStateRoot: parentRoot,
+		OldStateRoot: lb.parentRoot,
 		BlockNumber:  block.Number(),
 		BlockHash:    block.Hash(),
-	}, params, output, ipldOutput)
+	}, lb.params, output, ipldOutput)
 	prom.SetTimeMetric(prom.T_STATE_PROCESSING, time.Now().Sub(t))
-	t = time.Now()
-	err = tx.Submit()
-	prom.SetLastProcessedHeight(height)
-	prom.SetTimeMetric(prom.T_POSTGRES_TX_COMMIT, time.Now().Sub(t))
-	return err
+	span.SetAttributes(
+		attribute.Int64("diff.state_nodes", int64(timing.StateNodes)),
+		attribute.Int64("diff.iplds", int64(timing.IPLDs)))
+	if err != nil && !outputFailed.Load() {
+		err = wrapError(ErrStateUnavailable, err)
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return pb, err
+	}
+	timing.StateProcessing = time.Since(t)
+	timing.Bytes = size
+	return pendingBlock{
+		ctx:    ctx,
+		tx:     tx,
+		number: block.NumberU64(),
+		hash:   block.Hash(),
+		car:    carBlock,
+		size:   size,
+		timing: timing,
+	}, nil
 }
 
 // WriteStateDiffsInRange adds a RangeRequest to the work queue
-func (sds *Service) WriteStateDiffsInRange(start, stop uint64, params statediff.Params) error {
+func (sds *Service) WriteStateDiffsInRange(ctx context.Context, start, stop uint64, params statediff.Params, opts RangeOptions) error {
 	if stop < start {
 		return fmt.Errorf("invalid block range (%d, %d): stop height must be greater or equal to start height", start, stop)
 	}
-	blocked := time.NewTimer(30 * time.Second)
-	select {
-	case sds.queue <- RangeRequest{Start: start, Stop: stop, Params: params}:
-		prom.IncQueuedRanges()
-		logrus.Infof("Added range (%d, %d) to the worker queue", start, stop)
-		return nil
-	case <-blocked.C:
-		return fmt.Errorf("unable to add range (%d, %d) to the worker queue", start, stop)
+	if opts.SkipExisting && sds.marker == nil {
+		return fmt.Errorf("unable to skip existing blocks in range (%d, %d): no completion marker configured", start, stop)
+	}
+	rng := RangeRequest{Start: start, Stop: stop, Params: params, RangeOptions: opts}
+	job, err := sds.submitRange(ctx, withPriority(rng, PriorityNormal), jobOptions{})
+	if err != nil {
+		return fmt.Errorf("unable to add range (%d, %d) to the worker queue: %w", start, stop, err)
 	}
+	job.logQueued("")
+	return nil
 }
@@ -0,0 +1,261 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"math/big"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff"
+	"github.com/cerc-io/plugeth-statediff/indexer"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/dump"
+	"github.com/cerc-io/plugeth-statediff/indexer/database/file"
+	"github.com/cerc-io/plugeth-statediff/indexer/interfaces"
+	"github.com/cerc-io/plugeth-statediff/indexer/node"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+// Benchmarks of the diff and write path over a generated chain, e.g.
+//
+//	go test ./pkg -run '^$' -bench . -benchmem -bench.blocks 64 -bench.accounts 200 -bench.slots 100 -bench.trieWorkers 1,4,16
+var (
+	benchBlocks      = flag.Int("bench.blocks", 32, "number of blocks in the generated chain")
+	benchAccounts    = flag.Int("bench.accounts", 50, "number of new accounts funded per block")
+	benchSlots       = flag.Int("bench.slots", 50, "number of storage slots written per block")
+	benchSlotSpace   = flag.Int("bench.slotSpace", 1000, "number of distinct storage slots written to")
+	benchTrieWorkers = flag.String("bench.trieWorkers", "1,4", "comma separated trie worker counts to benchmark")
+	benchTrieCache   = flag.Int("bench.trieCache", 16, "trie clean cache size in MB")
+)
+
+var (
+	benchKey, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+	benchAddress = crypto.PubkeyToAddress(benchKey.PublicKey)
+	benchStorage = common.HexToAddress("0x00000000000000000000000000000000000051ab")
+	// SSTORE(calldata[0:32], calldata[32:64])
+	benchStorageCode = common.FromHex("0x6020356000355500")
+
+	benchParams = statediff.Params{
+		IncludeBlock:    true,
+		IncludeReceipts: true,
+		IncludeTD:       true,
+		IncludeCode:     true,
+	}
+
+	benchChainOnce sync.Once
+	benchChainDB   ethdb.Database
+	benchPromOnce  sync.Once
+)
+
+// benchChain generates the chain once per test binary and returns its database
+func benchChain(b *testing.B) ethdb.Database {
+	benchChainOnce.Do(func() {
+		logrus.SetLevel(logrus.WarnLevel)
+		genesis := &core.Genesis{
+			Config:   params.TestChainConfig,
+			GasLimit: 100_000_000,
+			BaseFee:  big.NewInt(params.InitialBaseFee),
+			Alloc: core.GenesisAlloc{
+				benchAddress: {Balance: new(big.Int).Lsh(big.NewInt(1), 100)},
+				benchStorage: {Balance: common.Big0, Code: benchStorageCode},
+			},
+		}
+		signer := types.LatestSigner(genesis.Config)
+		sign := func(gen *core.BlockGen, to common.Address, value *big.Int, gas uint64, data []byte) {
+			gasPrice := new(big.Int).Mul(gen.BaseFee(), big.NewInt(2))
+			tx := types.NewTransaction(gen.TxNonce(benchAddress), to, value, gas, gasPrice, data)
+			signed, err := types.SignTx(tx, signer, benchKey)
+			if err != nil {
+				panic(err)
+			}
+			gen.AddTx(signed)
+		}
+		_, blocks, _ := core.GenerateChainWithGenesis(genesis, ethash.NewFaker(), *benchBlocks, func(i int, gen *core.BlockGen) {
+			for j := 0; j < *benchAccounts; j++ {
+				to := common.BigToAddress(big.NewInt(int64(1_000_000 + i**benchAccounts + j)))
+				sign(gen, to, big.NewInt(1), params.TxGas, nil)
+			}
+			for j := 0; j < *benchSlots; j++ {
+				slot := (i**benchSlots + j*7919) % *benchSlotSpace
+				data := append(common.BigToHash(big.NewInt(int64(slot))).Bytes(), common.BigToHash(big.NewInt(int64(i+1))).Bytes()...)
+				sign(gen, benchStorage, common.Big0, 50_000, data)
+			}
+		})
+
+		// import the chain with archive settings, so the state of every block is kept
+		db := rawdb.NewMemoryDatabase()
+		cacheConfig := &core.CacheConfig{
+			TrieCleanLimit:    256,
+			TrieDirtyLimit:    256,
+			TrieTimeLimit:     5 * time.Minute,
+			TrieDirtyDisabled: true,
+		}
+		chain, err := core.NewBlockChain(db, cacheConfig, genesis, nil, ethash.NewFaker(), vm.Config{}, nil, nil)
+		if err != nil {
+			panic(err)
+		}
+		if _, err := chain.InsertChain(blocks); err != nil {
+			panic(err)
+		}
+		chain.Stop()
+		benchChainDB = db
+	})
+	return benchChainDB
+}
+
+// benchReader returns a reader over the generated chain with a fresh trie cache
+func benchReader(b *testing.B) *LvlDBReader {
+	db := benchChain(b)
+	return &LvlDBReader{
+		ethDB:       db,
+		stateDB:     state.NewDatabaseWithConfig(db, &trie.Config{Cache: *benchTrieCache}),
+		chainConfig: params.TestChainConfig,
+	}
+}
+
+func benchTrieWorkerCounts(b *testing.B) []uint {
+	var counts []uint
+	for _, s := range strings.Split(*benchTrieWorkers, ",") {
+		n, err := strconv.ParseUint(strings.TrimSpace(s), 10, 32)
+		if err != nil {
+			b.Fatalf("invalid trie worker count %q: %v", s, err)
+		}
+		counts = append(counts, uint(n))
+	}
+	return counts
+}
+
+func benchIndexer(b *testing.B, output string) interfaces.StateDiffIndexer {
+	var conf interfaces.Config
+	switch output {
+	case "discard":
+		conf = dump.Config{Dump: dump.Discard}
+	case "file":
+		dir := b.TempDir()
+		conf = file.Config{
+			Mode:                     file.CSV,
+			OutputDir:                dir,
+			WatchedAddressesFilePath: filepath.Join(dir, "statediff-watched-addresses.csv"),
+		}
+	}
+	nodeInfo := node.Info{
+		GenesisBlock: rawdb.ReadCanonicalHash(benchChain(b), 0).Hex(),
+		NetworkID:    "1",
+		ChainID:      params.TestChainConfig.ChainID.Uint64(),
+		ID:           "bench",
+		ClientName:   "eth-statediff-service",
+	}
+	_, ind, err := indexer.NewStateDiffIndexer(context.Background(), params.TestChainConfig, nodeInfo, conf, true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return ind
+}
+
+// stageTimes returns the total seconds and number of observations of each block processing stage
+func stageTimes(b *testing.B) map[string][2]float64 {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		b.Fatal(err)
+	}
+	times := make(map[string][2]float64)
+	for _, family := range families {
+		name := strings.TrimPrefix(family.GetName(), "eth_statediff_service_stats_")
+		if name == family.GetName() || len(family.GetMetric()) == 0 || family.GetMetric()[0].GetHistogram() == nil {
+			continue
+		}
+		h := family.GetMetric()[0].GetHistogram()
+		times[name] = [2]float64{h.GetSampleSum(), float64(h.GetSampleCount())}
+	}
+	return times
+}
+
+// reportStages reports the average time per block spent in each stage since the before snapshot
+func reportStages(b *testing.B, before map[string][2]float64) {
+	for _, stage := range []string{prom.T_BLOCK_LOAD, prom.T_BLOCK_PROCESSING, prom.T_STATE_PROCESSING, prom.T_POSTGRES_TX_COMMIT} {
+		after := stageTimes(b)[stage]
+		count := after[1] - before[stage][1]
+		if count > 0 {
+			b.ReportMetric((after[0]-before[stage][0])/count*1000, strings.TrimPrefix(stage, "t_")+"-ms/block")
+		}
+	}
+}
+
+func reportBlockRate(b *testing.B, elapsed time.Duration) {
+	b.ReportMetric(float64(b.N)/elapsed.Seconds(), "blocks/s")
+}
+
+func BenchmarkWriteStateDiffAt(b *testing.B) {
+	benchPromOnce.Do(prom.Init)
+	for _, output := range []string{"discard", "file"} {
+		for _, workers := range benchTrieWorkerCounts(b) {
+			b.Run(fmt.Sprintf("%s/trieWorkers=%d", output, workers), func(b *testing.B) {
+				ind := benchIndexer(b, output)
+				defer ind.Close()
+				sds := NewStateDiffService(benchReader(b), ind, ServiceConfig{ServiceWorkers: 1, TrieWorkers: workers})
+				before := stageTimes(b)
+				b.ReportAllocs()
+				b.ResetTimer()
+				start := time.Now()
+				for i := 0; i < b.N; i++ {
+					if err := sds.WriteStateDiffAt(uint64(1+i%*benchBlocks), benchParams); err != nil {
+						b.Fatal(err)
+					}
+				}
+				reportBlockRate(b, time.Since(start))
+				reportStages(b, before)
+			})
+		}
+	}
+}
+
+func BenchmarkStateDiffAt(b *testing.B) {
+	for _, workers := range benchTrieWorkerCounts(b) {
+		b.Run(fmt.Sprintf("trieWorkers=%d", workers), func(b *testing.B) {
+			sds := NewStateDiffService(benchReader(b), nil, ServiceConfig{ServiceWorkers: 1, TrieWorkers: workers})
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				if _, err := sds.StateDiffAt(uint64(1+i%*benchBlocks), benchParams); err != nil {
+					b.Fatal(err)
+				}
+			}
+			reportBlockRate(b, time.Since(start))
+		})
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// newTestService returns a service over an empty database
+func newTestService(conf ServiceConfig) *Service {
+	db := rawdb.NewMemoryDatabase()
+	reader := &LvlDBReader{ethDB: db, stateDB: state.NewDatabase(db), chainConfig: params.TestChainConfig}
+	return NewStateDiffService(reader, nil, conf)
+}
+
+func TestServiceStop(t *testing.T) {
+	sds := newTestService(ServiceConfig{ServiceWorkers: 2})
+	// stopping before the service was started, and more than once, is allowed
+	sds.Stop()
+	sds.Stop()
+	report, err := sds.Run(nil, true)
+	if err == nil {
+		t.Fatal("expected a stopped run to fail")
+	}
+	if report == nil || !report.Interrupted {
+		t.Fatalf("expected the run to be reported as interrupted, got %+v", report)
+	}
+	if _, err := sds.Run(nil, true); err == nil {
+		t.Fatal("expected a second run to be refused")
+	}
+}
+
+func TestRunOrder(t *testing.T) {
+	// no blocks exist, so every block fails
+	preruns := []RangeRequest{{Start: 1, Stop: 1}, {Start: 3, Stop: 3}}
+	sds := newTestService(ServiceConfig{ServiceWorkers: 2, PreRuns: preruns})
+	report, err := sds.Run([]RangeRequest{{Start: 2, Stop: 2, RangeOptions: RangeOptions{Priority: PriorityInteractive}}}, false)
+	if err == nil {
+		t.Fatal("expected the run to fail")
+	}
+	// a sequential run processes the pre-runs first, in order, and stops at the first failed range
+	if len(report.Ranges) != 3 {
+		t.Fatalf("expected 3 ranges in the report, got %d", len(report.Ranges))
+	}
+	if r := report.Ranges[0]; r.Start != 1 || r.Failed != 1 {
+		t.Errorf("expected the first pre-run to fail, got %+v", r)
+	}
+	for _, r := range report.Ranges[1:] {
+		if r.Processed+r.Failed != 0 || r.Error == "" {
+			t.Errorf("expected range (%d, %d) to be dropped, got %+v", r.Start, r.Stop, r)
+		}
+	}
+	if len(report.FailedHeights) != 1 || report.FailedHeights[0] != 1 {
+		t.Errorf("expected only block 1 to fail, got %v", report.FailedHeights)
+	}
+}
+
+// workerIDs returns the IDs of the running workers
+func workerIDs(sds *Service) []int {
+	sds.workersMtx.Lock()
+	defer sds.workersMtx.Unlock()
+	var ids []int
+	for id := range sds.progress {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func TestWorkerIDs(t *testing.T) {
+	sds := newTestService(ServiceConfig{ServiceWorkers: 3})
+	var wg sync.WaitGroup
+	sds.startWorkers(&wg, 3)
+	defer func() {
+		sds.Stop()
+		wg.Wait()
+	}()
+	if err := sds.SetServiceWorkers(1); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the retired workers to exit", func() bool { return len(workerIDs(sds)) == 1 })
+	// a new worker takes the lowest free ID, rather than a new one
+	if err := sds.SetServiceWorkers(2); err != nil {
+		t.Fatal(err)
+	}
+	if ids := workerIDs(sds); len(ids) != 2 || ids[0] != 0 || ids[1] != 1 {
+		t.Errorf("expected workers 0 and 1, got %v", ids)
+	}
+}
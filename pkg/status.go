@@ -0,0 +1,267 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// number of failed blocks kept for the status page
+	recentFailureCount = 20
+	// number of slow blocks shown on the status page
+	statusSlowBlocks = 10
+)
+
+// Status is a snapshot of the state of the service, shown on the status page
+type Status struct {
+	Time         time.Time
+	HeadNumber   uint64
+	HeadHash     common.Hash
+	HeadTime     time.Time
+	HeadError    string
+	Output       OutputStatus
+	Workers      WorkerStatus
+	Jobs         []JobStatus
+	WorkerStates []WorkerState
+	Failures     []BlockFailure
+	SlowBlocks   []BlockTiming
+}
+
+// OutputStatus describes where the service writes the state diffs
+type OutputStatus struct {
+	Indexer    string
+	CarDir     string
+	CarVersion int
+	// how written blocks are recorded, empty if they are not
+	CompletionMarker string
+	// maximum number of open indexer transactions, zero if unlimited
+	MaxOpenTxs    uint
+	PipelineDepth uint
+}
+
+// JobStatus describes a queued or active range job
+type JobStatus struct {
+	ID                         uint64
+	Start, Stop                uint64
+	Priority                   Priority
+	Queued                     bool
+	Active                     int
+	Processed, Skipped, Failed uint64
+	Started                    time.Time
+	Error                      string
+}
+
+// Total returns the number of blocks of the job
+func (j JobStatus) Total() uint64 {
+	return j.Stop - j.Start + 1
+}
+
+// Done returns the number of blocks of the job in finished batches
+func (j JobStatus) Done() uint64 {
+	return j.Processed + j.Skipped + j.Failed
+}
+
+// WorkerState describes what a worker is doing
+type WorkerState struct {
+	Worker      int
+	Interactive bool
+	Busy        bool
+	Job         uint64
+	Block       uint64
+	Since       time.Time
+}
+
+// BlockFailure is a block which failed to be written
+type BlockFailure struct {
+	Block uint64
+	Job   uint64
+	Time  time.Time
+	Error string
+}
+
+// failureLog keeps the most recent block failures
+type failureLog struct {
+	mtx      sync.Mutex
+	failures []BlockFailure
+}
+
+func (l *failureLog) add(f BlockFailure) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.failures) == recentFailureCount {
+		l.failures = l.failures[1:]
+	}
+	l.failures = append(l.failures, f)
+}
+
+// recent returns the failures, most recent first
+func (l *failureLog) recent() []BlockFailure {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	failures := make([]BlockFailure, len(l.failures))
+	for i, f := range l.failures {
+		failures[len(failures)-1-i] = f
+	}
+	return failures
+}
+
+// markerDescription describes how written blocks are recorded
+func markerDescription(marker CompletionMarker) string {
+	switch marker.(type) {
+	case nil:
+		return ""
+	case *DBMarker:
+		return "looked up in the database"
+	case *LogMarker:
+		return "completion log"
+	}
+	return fmt.Sprintf("%T", marker)
+}
+
+// Status returns a snapshot of the state of the service
+func (sds *Service) Status() Status {
+	s := Status{
+		Time: time.Now(),
+		Output: OutputStatus{
+			Indexer:          fmt.Sprintf("%T", sds.indexer),
+			CarDir:           sds.carDir,
+			CarVersion:       sds.carVersion,
+			CompletionMarker: markerDescription(sds.marker),
+			MaxOpenTxs:       uint(cap(sds.txSlots)),
+			PipelineDepth:    sds.pipelineDepth,
+		},
+		Workers:    sds.WorkerStatus(),
+		Failures:   sds.failures.recent(),
+		SlowBlocks: sds.SlowBlocks(statusSlowBlocks),
+	}
+	if header, err := sds.lvlDBReader.GetLatestHeader(); err != nil {
+		s.HeadError = err.Error()
+	} else {
+		s.HeadNumber, s.HeadHash = header.Number.Uint64(), header.Hash()
+		s.HeadTime = time.Unix(int64(header.Time), 0)
+	}
+
+	var active []*rangeJob
+	sds.workersMtx.Lock()
+	for id, p := range sds.progress {
+		job, block, since, busy := p.current()
+		state := WorkerState{Worker: id, Interactive: p.interactive, Busy: busy}
+		if busy {
+			state.Job, state.Block, state.Since = job.id, block, since
+			active = append(active, job)
+		}
+		s.WorkerStates = append(s.WorkerStates, state)
+	}
+	sds.workersMtx.Unlock()
+	sort.Slice(s.WorkerStates, func(i, j int) bool {
+		return s.WorkerStates[i].Worker < s.WorkerStates[j].Worker
+	})
+	s.Jobs = sds.sched.jobStatus(active)
+	return s
+}
+
+// StatusHandler serves the status page
+func (sds *Service) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusPage.Execute(w, sds.Status()); err != nil {
+			logrus.Errorf("error writing status page: %v", err)
+		}
+	})
+}
+
+var statusPage = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		return time.Since(t).Round(time.Second).String()
+	},
+	"ms": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>eth-statediff-service status</title>
+<style>
+body { font-family: sans-serif; font-size: 14px; margin: 1em 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 3px 8px; text-align: left; }
+th { background: #eee; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>eth-statediff-service</h1>
+<p>As of {{.Time.Format "2006-01-02 15:04:05 MST"}}, refreshed every 10s</p>
+
+<h2>LevelDB head</h2>
+{{if .HeadError}}<p class="error">{{.HeadError}}</p>{{else}}
+<p>Block {{.HeadNumber}} ({{.HeadHash.Hex}}), {{ago .HeadTime}} old</p>{{end}}
+
+<h2>Output</h2>
+<table>
+<tr><th>Indexer</th><td>{{.Output.Indexer}}</td></tr>
+<tr><th>CAR files</th><td>{{if .Output.CarDir}}{{.Output.CarDir}} (v{{.Output.CarVersion}}){{else}}disabled{{end}}</td></tr>
+<tr><th>Completed blocks</th><td>{{or .Output.CompletionMarker "not recorded"}}</td></tr>
+<tr><th>Open transactions</th><td>{{with .Output.MaxOpenTxs}}at most {{.}}{{else}}unlimited{{end}}</td></tr>
+<tr><th>Pipeline depth</th><td>{{.Output.PipelineDepth}}</td></tr>
+</table>
+
+<h2>Jobs</h2>
+<p>{{.Workers.ServiceWorkers}} service workers, {{.Workers.InteractiveWorkers}} interactive workers, {{.Workers.TrieWorkers}} trie workers{{if .Workers.Paused}}, <b>paused</b>{{end}}</p>
+{{if .Jobs}}<table>
+<tr><th>Job</th><th>Range</th><th>Priority</th><th>Progress</th><th>Processed</th><th>Skipped</th><th>Failed</th><th>Batches</th><th>Age</th><th>Error</th></tr>
+{{range .Jobs}}<tr>
+<td>{{.ID}}</td><td>{{.Start}} - {{.Stop}}</td><td>{{.Priority}}</td>
+<td><progress value="{{.Done}}" max="{{.Total}}"></progress> {{.Done}} / {{.Total}}</td>
+<td>{{.Processed}}</td><td>{{.Skipped}}</td><td>{{.Failed}}</td><td>{{.Active}}{{if .Queued}} (more queued){{end}}</td>
+<td>{{ago .Started}}</td><td class="error">{{.Error}}</td>
+</tr>{{end}}
+</table>{{else}}<p>No queued or active jobs</p>{{end}}
+
+<h2>Workers</h2>
+<table>
+<tr><th>Worker</th><th>Kind</th><th>State</th><th>Job</th><th>Block</th><th>On block for</th></tr>
+{{range .WorkerStates}}<tr>
+<td>{{.Worker}}</td><td>{{if .Interactive}}interactive{{else}}service{{end}}</td>
+{{if .Busy}}<td>busy</td><td>{{.Job}}</td><td>{{.Block}}</td><td>{{ago .Since}}</td>{{else}}<td>idle</td><td></td><td></td><td></td>{{end}}
+</tr>{{end}}
+</table>
+
+<h2>Recent failures</h2>
+{{if .Failures}}<table>
+<tr><th>Block</th><th>Job</th><th>When</th><th>Error</th></tr>
+{{range .Failures}}<tr><td>{{.Block}}</td><td>{{.Job}}</td><td>{{ago .Time}} ago</td><td class="error">{{.Error}}</td></tr>{{end}}
+</table>{{else}}<p>None</p>{{end}}
+
+<h2>Slow blocks</h2>
+{{if .SlowBlocks}}<table>
+<tr><th>Block</th><th>Total</th><th>Load</th><th>Block processing</th><th>State processing</th><th>Commit</th><th>State nodes</th><th>Storage nodes</th><th>Bytes</th></tr>
+{{range .SlowBlocks}}<tr><td>{{.Number}}</td><td>{{ms .Total}}</td><td>{{ms .Load}}</td><td>{{ms .BlockProcessing}}</td><td>{{ms .StateProcessing}}</td><td>{{ms .Commit}}</td><td>{{.StateNodes}}</td><td>{{.StorageNodes}}</td><td>{{.Bytes}}</td></tr>{{end}}
+</table>{{else}}<p>No timings recorded (statediff.timingHistory)</p>{{end}}
+</body>
+</html>
+`))
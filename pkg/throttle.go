@@ -0,0 +1,224 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+const (
+	defaultThrottleInterval = 10 * time.Second
+	defaultThrottleMaxDelay = 5 * time.Second
+	// first delay inserted once concurrency is down to a single block
+	minThrottleDelay = 50 * time.Millisecond
+)
+
+// ThrottleConfig configures adaptive throttling on database commit latency
+type ThrottleConfig struct {
+	// Commit latency to stay under; throttling is disabled if zero
+	TargetLatency time.Duration
+	// How often the commit latency is evaluated
+	Interval time.Duration
+	// Maximum delay inserted before writing each block
+	MaxDelay time.Duration
+	// Source of the connection pool wait counts, may be nil
+	DBStats prom.DBStatsGetter
+}
+
+// throttle limits the number of blocks concurrently written to the database, and inserts delays
+// before writing a block once that limit is down to one. Every interval the average commit latency
+// and the number of waits for a pool connection are checked: while the latency exceeds the target
+// or connections were waited for, the limit is halved (and then the delay doubled); once the
+// database is healthy again the delay is halved and then the limit raised by one.
+//
+// A nil throttle does not limit anything.
+type throttle struct {
+	ThrottleConfig
+	// upper bound of the limit, the number of blocks the running workers can hold in processing
+	maxLimit func() int
+
+	mtx    sync.Mutex
+	limit  int
+	active int
+	delay  time.Duration
+	wake   chan struct{}
+	// commit latency observed in the current interval
+	latency time.Duration
+	commits int
+	// pool wait count at the previous evaluation
+	waitCount int64
+}
+
+func newThrottle(conf ThrottleConfig, maxLimit func() int) *throttle {
+	if conf.TargetLatency == 0 {
+		return nil
+	}
+	if conf.Interval == 0 {
+		conf.Interval = defaultThrottleInterval
+	}
+	if conf.MaxDelay == 0 {
+		conf.MaxDelay = defaultThrottleMaxDelay
+	}
+	t := &throttle{
+		ThrottleConfig: conf,
+		maxLimit:       maxLimit,
+		limit:          maxLimit(),
+		wake:           make(chan struct{}),
+	}
+	if conf.DBStats != nil {
+		t.waitCount = conf.DBStats.Stats().WaitCount()
+	}
+	return t
+}
+
+// acquire waits until another block may be written, returning false if quit was closed first.
+// Every successful acquire must be followed by a release.
+func (t *throttle) acquire(quit <-chan struct{}) bool {
+	if t == nil {
+		return true
+	}
+	t.mtx.Lock()
+	for t.active >= t.limit {
+		wake := t.wake
+		t.mtx.Unlock()
+		select {
+		case <-wake:
+		case <-quit:
+			return false
+		}
+		t.mtx.Lock()
+	}
+	t.active++
+	delay := t.delay
+	t.mtx.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-quit:
+		}
+	}
+	return true
+}
+
+// release marks a block as written
+func (t *throttle) release() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.active--
+	t.signal()
+}
+
+// observeCommit records the latency of a commit
+func (t *throttle) observeCommit(d time.Duration) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.latency += d
+	t.commits++
+}
+
+// run evaluates the commit latency every interval until quit is closed
+func (t *throttle) run(quit <-chan struct{}) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.adjust()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// adjust updates the limit and delay from the observations of the last interval
+func (t *throttle) adjust() {
+	var waits int64
+	if t.DBStats != nil {
+		count := t.DBStats.Stats().WaitCount()
+		waits = count - t.waitCount
+		t.waitCount = count
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	var avg time.Duration
+	if t.commits > 0 {
+		avg = t.latency / time.Duration(t.commits)
+	}
+	t.latency, t.commits = 0, 0
+	maxLimit := t.maxLimit()
+	if maxLimit < 1 {
+		maxLimit = 1
+	}
+	limit, delay := t.limit, t.delay
+
+	switch {
+	case avg > t.TargetLatency || waits > 0:
+		if limit > 1 {
+			limit /= 2
+		} else if delay == 0 {
+			delay = minThrottleDelay
+		} else {
+			delay *= 2
+			if delay > t.MaxDelay {
+				delay = t.MaxDelay
+			}
+		}
+	case avg < t.TargetLatency*4/5:
+		if delay > minThrottleDelay {
+			delay /= 2
+		} else if delay > 0 {
+			delay = 0
+		} else if limit < maxLimit {
+			limit++
+		}
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	if limit != t.limit || delay != t.delay {
+		logrus.WithFields(logrus.Fields{
+			"latency": avg,
+			"waits":   waits,
+			"limit":   limit,
+			"delay":   delay,
+		}).Info("Adjusted database throttle")
+	}
+	t.limit, t.delay = limit, delay
+	prom.SetThrottle(limit, delay)
+	t.signal()
+}
+
+// signal wakes up all waiting acquires; the mutex must be held
+func (t *throttle) signal() {
+	close(t.wake)
+	t.wake = make(chan struct{})
+}
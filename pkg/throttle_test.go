@@ -0,0 +1,190 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"testing"
+	"time"
+
+	dbmetrics "github.com/cerc-io/plugeth-statediff/indexer/database/metrics"
+)
+
+const testTargetLatency = 100 * time.Millisecond
+
+// poolStats reports a settable number of waits for a pool connection
+type poolStats struct {
+	dbmetrics.DbStats
+	waits int64
+}
+
+func (s *poolStats) WaitCount() int64 { return s.waits }
+
+// poolStatsGetter returns the same stats on every call
+type poolStatsGetter struct{ stats *poolStats }
+
+func (g poolStatsGetter) Stats() dbmetrics.DbStats { return g.stats }
+
+// interval records the commit latency of an interval and evaluates it
+func interval(t *throttle, latency time.Duration) {
+	t.observeCommit(latency)
+	t.adjust()
+}
+
+func assertThrottle(t *testing.T, th *throttle, limit int, delay time.Duration) {
+	t.Helper()
+	if th.limit != limit || th.delay != delay {
+		t.Fatalf("expected limit %d and delay %v, got limit %d and delay %v", limit, delay, th.limit, th.delay)
+	}
+}
+
+func TestThrottleDisabled(t *testing.T) {
+	th := newThrottle(ThrottleConfig{}, func() int { return 4 })
+	if th != nil {
+		t.Fatal("expected no throttle without a target latency")
+	}
+	// a nil throttle limits nothing
+	for i := 0; i < 10; i++ {
+		if !th.acquire(nil) {
+			t.Fatal("expected a nil throttle to admit every block")
+		}
+	}
+	th.release()
+	th.observeCommit(time.Second)
+}
+
+func TestThrottleAIMD(t *testing.T) {
+	th := newThrottle(ThrottleConfig{TargetLatency: testTargetLatency, MaxDelay: 300 * time.Millisecond}, func() int { return 8 })
+	assertThrottle(t, th, 8, 0)
+
+	// multiplicative decrease of the limit while the latency is over the target...
+	interval(th, 2*testTargetLatency)
+	assertThrottle(t, th, 4, 0)
+	interval(th, 2*testTargetLatency)
+	interval(th, 2*testTargetLatency)
+	assertThrottle(t, th, 1, 0)
+	// ...then a growing delay, up to the maximum
+	interval(th, 2*testTargetLatency)
+	assertThrottle(t, th, 1, minThrottleDelay)
+	interval(th, 2*testTargetLatency)
+	assertThrottle(t, th, 1, 2*minThrottleDelay)
+	for i := 0; i < 5; i++ {
+		interval(th, 2*testTargetLatency)
+	}
+	assertThrottle(t, th, 1, 300*time.Millisecond)
+
+	// a latency just under the target keeps the current settings
+	interval(th, testTargetLatency*9/10)
+	assertThrottle(t, th, 1, 300*time.Millisecond)
+
+	// once healthy, the delay is halved and dropped first...
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 1, 150*time.Millisecond)
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 1, 75*time.Millisecond)
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 1, 75*time.Millisecond/2)
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 1, 0)
+	// ...then the limit is raised additively, up to the number of workers
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 2, 0)
+	for i := 0; i < 10; i++ {
+		interval(th, testTargetLatency/2)
+	}
+	assertThrottle(t, th, 8, 0)
+
+	// intervals without commits count as healthy
+	th.adjust()
+	assertThrottle(t, th, 8, 0)
+}
+
+func TestThrottlePoolWaits(t *testing.T) {
+	stats := &poolStats{waits: 10}
+	th := newThrottle(ThrottleConfig{TargetLatency: testTargetLatency, DBStats: poolStatsGetter{stats}}, func() int { return 4 })
+	// waits before the throttle was created don't count
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 4, 0)
+
+	// waiting for a pool connection backs off even with a fast commit latency
+	stats.waits = 12
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 2, 0)
+	interval(th, testTargetLatency/2)
+	assertThrottle(t, th, 3, 0)
+}
+
+func TestThrottleWorkerLimit(t *testing.T) {
+	workers := 4
+	th := newThrottle(ThrottleConfig{TargetLatency: testTargetLatency}, func() int { return workers })
+	// the limit follows the number of workers down, and never below one
+	workers = 2
+	th.adjust()
+	assertThrottle(t, th, 2, 0)
+	workers = 0
+	th.adjust()
+	assertThrottle(t, th, 1, 0)
+}
+
+func TestThrottleAcquire(t *testing.T) {
+	th := newThrottle(ThrottleConfig{TargetLatency: testTargetLatency}, func() int { return 2 })
+	interval(th, 2*testTargetLatency)
+	assertThrottle(t, th, 1, 0)
+
+	if !th.acquire(nil) {
+		t.Fatal("expected the first block to be admitted")
+	}
+	acquired := make(chan bool)
+	quit := make(chan struct{})
+	go func() { acquired <- th.acquire(quit) }()
+	select {
+	case <-acquired:
+		t.Fatal("expected the second block to wait while the limit is reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+	th.release()
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("expected the second block to be admitted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the second block was not admitted after a release")
+	}
+
+	// a waiting block gives up when quit is closed
+	go func() { acquired <- th.acquire(quit) }()
+	close(quit)
+	select {
+	case ok := <-acquired:
+		if ok {
+			t.Fatal("expected the waiting block not to be admitted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting block did not give up on quit")
+	}
+
+	// raising the limit admits a waiting block
+	go func() { acquired <- th.acquire(nil) }()
+	interval(th, testTargetLatency/2)
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("expected the block to be admitted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the waiting block was not admitted after the limit was raised")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+)
+
+// TimingConfig controls the per-block timing history
+type TimingConfig struct {
+	// Number of most recently written blocks to keep timings for; disabled if zero
+	History uint
+	// Log a warning with the timing breakdown of blocks taking at least this long; disabled if zero
+	SlowThreshold time.Duration
+}
+
+// BlockTiming is the time spent in each stage of writing a block, and the amount of data written.
+// Durations are in nanoseconds.
+type BlockTiming struct {
+	Number          uint64        `json:"number"`
+	Hash            common.Hash   `json:"hash"`
+	Load            time.Duration `json:"load"`
+	BlockProcessing time.Duration `json:"blockProcessing"`
+	StateProcessing time.Duration `json:"stateProcessing"`
+	Commit          time.Duration `json:"commit"`
+	Total           time.Duration `json:"total"`
+	DiffStats
+	Written time.Time `json:"written"`
+}
+
+// DiffStats counts what was written for a block
+type DiffStats struct {
+	StateNodes   uint64 `json:"stateNodes"`
+	StorageNodes uint64 `json:"storageNodes"`
+	// state and storage nodes which were removed
+	RemovedNodes uint64 `json:"removedNodes"`
+	IPLDs        uint64 `json:"iplds"`
+	// contract code blobs, which are also counted as IPLDs
+	Codes        uint64 `json:"codes"`
+	Transactions uint64 `json:"transactions"`
+	Receipts     uint64 `json:"receipts"`
+	Logs         uint64 `json:"logs"`
+	// approximate number of bytes written to the indexer
+	Bytes uint64 `json:"bytes"`
+}
+
+// observe records the stats of a written block in the content metrics
+func (s DiffStats) observe() {
+	prom.ObserveDiffItems(prom.DIFF_STATE_NODES, s.StateNodes)
+	prom.ObserveDiffItems(prom.DIFF_STORAGE_NODES, s.StorageNodes)
+	prom.ObserveDiffItems(prom.DIFF_REMOVED_NODES, s.RemovedNodes)
+	prom.ObserveDiffItems(prom.DIFF_IPLDS, s.IPLDs)
+	prom.ObserveDiffItems(prom.DIFF_CODES, s.Codes)
+	prom.ObserveDiffItems(prom.DIFF_TRANSACTIONS, s.Transactions)
+	prom.ObserveDiffItems(prom.DIFF_RECEIPTS, s.Receipts)
+	prom.ObserveDiffItems(prom.DIFF_LOGS, s.Logs)
+	prom.ObserveDiffBytes(s.Bytes)
+	if s.StateNodes == 0 {
+		prom.IncEmptyDiffs()
+	}
+}
+
+// timingHistory keeps the timings of the most recently written blocks in a ring buffer
+type timingHistory struct {
+	threshold time.Duration
+
+	mtx  sync.Mutex
+	buf  []BlockTiming
+	next int
+	full bool
+}
+
+// newTimingHistory returns the timing history for the config, or nil if neither the history
+// nor slow block logging is enabled
+func newTimingHistory(conf TimingConfig) *timingHistory {
+	if conf.History == 0 && conf.SlowThreshold == 0 {
+		return nil
+	}
+	return &timingHistory{
+		threshold: conf.SlowThreshold,
+		buf:       make([]BlockTiming, conf.History),
+	}
+}
+
+// record adds the timing of a written block, and logs it if the block was slow
+func (h *timingHistory) record(ctx context.Context, t BlockTiming) {
+	if h == nil {
+		return
+	}
+	t.Total = t.Load + t.BlockProcessing + t.StateProcessing + t.Commit
+	t.Written = time.Now()
+	if h.threshold > 0 && t.Total >= h.threshold {
+		logger(ctx).WithFields(logrus.Fields{
+			fieldEvent:        eventSlowBlock,
+			fieldDuration:     t.Total,
+			"load":            t.Load,
+			"blockProcessing": t.BlockProcessing,
+			"stateProcessing": t.StateProcessing,
+			"commit":          t.Commit,
+			"stateNodes":      t.StateNodes,
+			"storageNodes":    t.StorageNodes,
+			"removedNodes":    t.RemovedNodes,
+			"iplds":           t.IPLDs,
+			"codes":           t.Codes,
+			"bytes":           t.Bytes,
+		}).Warnf("Slow block %d took %s", t.Number, t.Total)
+	}
+
+	if len(h.buf) == 0 {
+		return
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.buf[h.next] = t
+	h.next++
+	if h.next == len(h.buf) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// slowest returns up to n of the recorded blocks, slowest first
+func (h *timingHistory) slowest(n int) []BlockTiming {
+	if h == nil {
+		return nil
+	}
+	h.mtx.Lock()
+	count := h.next
+	if h.full {
+		count = len(h.buf)
+	}
+	timings := make([]BlockTiming, count)
+	copy(timings, h.buf[:count])
+	h.mtx.Unlock()
+
+	sort.Slice(timings, func(i, j int) bool {
+		return timings[i].Total > timings[j].Total
+	})
+	if n < len(timings) {
+		timings = timings[:n]
+	}
+	return timings
+}
+
+// SlowBlocks returns up to n of the most recently written blocks, slowest first
+func (sds *Service) SlowBlocks(n uint) []BlockTiming {
+	return sds.timings.slowest(int(n))
+}
@@ -29,6 +29,49 @@ import (
 type RangeRequest struct {
 	Start, Stop uint64
 	Params      sd.Params
+	RangeOptions
+}
+
+// RangeOptions holds the optional processing settings for a range
+type RangeOptions struct {
+	// SkipExisting skips blocks which are already recorded as complete
+	SkipExisting bool `json:"skipExisting"`
+	// Priority is the class the range is scheduled in; empty means the default for the request
+	Priority Priority `json:"priority,omitempty"`
+}
+
+// Priority classes for scheduling ranges; workers always pick up the highest class first
+type Priority string
+
+const (
+	PriorityInteractive Priority = "interactive"
+	PriorityNormal      Priority = "normal"
+	PriorityBulk        Priority = "bulk"
+)
+
+// Priorities lists the priority classes from highest to lowest
+var Priorities = []Priority{PriorityInteractive, PriorityNormal, PriorityBulk}
+
+// level returns the scheduling level of the priority class, higher levels are scheduled first
+func (p Priority) level() (int, error) {
+	switch p {
+	case PriorityBulk:
+		return 0, nil
+	case PriorityNormal:
+		return 1, nil
+	case PriorityInteractive:
+		return 2, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q", p)
+}
+
+// Validate checks that the priority is a known class or empty
+func (p Priority) Validate() error {
+	if p == "" {
+		return nil
+	}
+	_, err := p.level()
+	return err
 }
 
 func (r RangeRequest) String() string {
@@ -0,0 +1,217 @@
+// Copyright © 2023 Vulcanize, Inc
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package statediff
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cerc-io/plugeth-statediff"
+	"github.com/cerc-io/plugeth-statediff/adapt"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/cerc-io/eth-statediff-service/pkg/prom"
+	"github.com/cerc-io/eth-statediff-service/pkg/tracing"
+)
+
+// WorkerStatus describes the current worker configuration of the service
+type WorkerStatus struct {
+	ServiceWorkers     uint `json:"serviceWorkers"`
+	InteractiveWorkers uint `json:"interactiveWorkers"`
+	TrieWorkers        uint `json:"trieWorkers"`
+	Paused             bool `json:"paused"`
+	QueuedRanges       int  `json:"queuedRanges"`
+}
+
+// startWorkers starts the given number of workers processing batches from the service's scheduler,
+// plus the workers reserved for interactive requests
+func (sds *Service) startWorkers(wg *sync.WaitGroup, workers int) {
+	sds.workersMtx.Lock()
+	defer sds.workersMtx.Unlock()
+	sds.workerWg = wg
+	for i := 0; i < workers; i++ {
+		retire := make(chan struct{})
+		sds.retire = append(sds.retire, retire)
+		sds.startWorker(0, retire)
+	}
+	interactive, _ := PriorityInteractive.level()
+	for i := 0; i < int(sds.interactiveWorkers); i++ {
+		sds.startWorker(interactive, nil)
+	}
+	prom.SetServiceWorkers(workers)
+}
+
+// startWorker starts a worker under the lowest free ID, so that the worker metrics keep a bounded set
+// of labels; the workers mutex must be held
+func (sds *Service) startWorker(minLevel int, retire <-chan struct{}) {
+	if sds.progress == nil {
+		sds.progress = make(map[int]*workerProgress)
+	}
+	id := 0
+	for sds.progress[id] != nil {
+		id++
+	}
+	progress := newWorkerProgress(id, minLevel > 0)
+	sds.progress[id] = progress
+	sds.workerWg.Add(1)
+	go func() {
+		defer sds.workerWg.Done()
+		defer sds.removeWorker(id)
+		sds.runWorker(id, minLevel, retire, progress)
+	}()
+}
+
+// removeWorker removes the progress of an exited worker
+func (sds *Service) removeWorker(id int) {
+	sds.workersMtx.Lock()
+	defer sds.workersMtx.Unlock()
+	sds.progress[id].close()
+	delete(sds.progress, id)
+}
+
+// runWorker processes batches of the priority classes at or above minLevel until the scheduler is
+// closed and drained, the service is stopped, or the worker is retired
+func (sds *Service) runWorker(id, minLevel int, retire <-chan struct{}, progress *workerProgress) {
+	sched, quit := sds.sched, sds.quitChan
+	for {
+		b, ok := sched.claim(quit, retire, minLevel)
+		if !ok {
+			logrus.WithField(fieldWorker, id).Debugf("closing the statediff service worker %d", id)
+			return
+		}
+		ctx, span := tracing.Start(b.job.ctx, "batch", append(tracing.Range(b.Start, b.Stop), attribute.Int("worker.id", id))...)
+		ctx = withLogFields(ctx, logrus.Fields{fieldWorker: id})
+		log := logger(ctx)
+		log.WithFields(logrus.Fields{
+			fieldEvent: eventBatchStarted,
+			fieldStart: b.Start,
+			fieldStop:  b.Stop,
+		}).Debugf("processing batch (%d, %d)", b.Start, b.Stop)
+		progress.startBatch(b.job, b.Start)
+		res := sds.processRange(ctx, b.RangeRequest, b.job.out, quit, progress, func(height uint64, err error) bool {
+			recordError(err)
+			sds.failures.add(BlockFailure{Block: height, Job: b.job.id, Time: time.Now(), Error: err.Error()})
+			log.WithFields(logrus.Fields{
+				fieldEvent: eventBlockFailed,
+				fieldBlock: height,
+			}).Errorf("error writing statediff at block %d: %v", height, err)
+			return !b.job.failFast
+		})
+		if res.err != nil && !b.job.failFast {
+			log.Errorf("error finishing batch (%d, %d): %v", b.Start, b.Stop, res.err)
+		}
+		progress.endBatch()
+		log.WithFields(logrus.Fields{
+			fieldEvent:  eventBatchFinished,
+			fieldStart:  b.Start,
+			fieldStop:   b.Stop,
+			"processed": res.processed,
+			"skipped":   res.skipped,
+			"failed":    res.failed,
+		}).Debugf("finished batch (%d, %d)", b.Start, b.Stop)
+		tracing.End(span, res.err)
+		sched.finish(b, res)
+		if res.quit {
+			log.Infof("closing service worker (last processed block: %d)", res.last)
+			return
+		}
+	}
+}
+
+// SetServiceWorkers scales the number of service workers. Retired workers finish the batch they are
+// processing; the remaining blocks of their ranges stay queued for the other workers.
+// At least one worker is required; Pause stops processing instead.
+func (sds *Service) SetServiceWorkers(workers uint) error {
+	if workers == 0 {
+		return fmt.Errorf("at least one service worker is required, use admin_pause to stop processing")
+	}
+	sds.workersMtx.Lock()
+	defer sds.workersMtx.Unlock()
+	if sds.workerWg == nil {
+		return fmt.Errorf("service workers are not running")
+	}
+	for uint(len(sds.retire)) < workers {
+		retire := make(chan struct{})
+		sds.retire = append(sds.retire, retire)
+		sds.startWorker(0, retire)
+	}
+	for uint(len(sds.retire)) > workers {
+		last := len(sds.retire) - 1
+		close(sds.retire[last])
+		sds.retire = sds.retire[:last]
+	}
+	logrus.Infof("Set number of service workers to %d", workers)
+	sds.workers = workers
+	prom.SetServiceWorkers(int(workers))
+	return nil
+}
+
+// SetTrieWorkers sets the number of subtrie workers used for state diffs started from now on
+func (sds *Service) SetTrieWorkers(workers uint) error {
+	if workers == 0 {
+		return fmt.Errorf("at least one trie worker is required")
+	}
+	builder := statediff.NewBuilder(adapt.GethStateView(sds.lvlDBReader.StateDB()))
+	builder.SetSubtrieWorkers(workers)
+	sds.builderMtx.Lock()
+	defer sds.builderMtx.Unlock()
+	sds.builder = builder
+	sds.trieWorkers = workers
+	logrus.Infof("Set number of trie workers to %d", workers)
+	prom.SetTrieWorkers(int(workers))
+	return nil
+}
+
+// getBuilder returns the current state diff builder
+func (sds *Service) getBuilder() statediff.Builder {
+	sds.builderMtx.RLock()
+	defer sds.builderMtx.RUnlock()
+	return sds.builder
+}
+
+// Pause stops handing out work to the workers; the batches in progress are finished and queued ranges are kept
+func (sds *Service) Pause() {
+	sds.sched.setPaused(true)
+	logrus.Info("Paused processing")
+	prom.SetPaused(true)
+}
+
+// Resume resumes handing out work to the workers
+func (sds *Service) Resume() {
+	sds.sched.setPaused(false)
+	logrus.Info("Resumed processing")
+	prom.SetPaused(false)
+}
+
+// WorkerStatus returns the current worker configuration
+func (sds *Service) WorkerStatus() WorkerStatus {
+	sds.workersMtx.Lock()
+	workers := sds.workers
+	sds.workersMtx.Unlock()
+	sds.builderMtx.RLock()
+	trieWorkers := sds.trieWorkers
+	sds.builderMtx.RUnlock()
+	queued, paused := sds.sched.status()
+	return WorkerStatus{
+		ServiceWorkers:     workers,
+		InteractiveWorkers: sds.interactiveWorkers,
+		TrieWorkers:        trieWorkers,
+		Paused:             paused,
+		QueuedRanges:       queued,
+	}
+}
@@ -51,6 +51,7 @@ export ETH_NETWORK_ID=test-network
 
 export SERVICE_HTTP_PATH='127.0.0.1:8545'
 export LOG_LEVEL=debug
+export LOG_FORMAT=json
 
 dump_table() {
   statement="copy (select * from $1) to stdout with csv"
@@ -79,6 +80,17 @@ for table in "${tables[@]}"; do
   clear_table $table
 done
 
+# the range_finished event is only logged once every block of the range is done; versions
+# without it (and without JSON logs) are detected by the message of the last block
+range_finished() {
+  jq -e -R --argjson stop $range_end \
+    'fromjson? | select(.event == "range_finished" and .stop == $stop)' $LOG_FILE ||
+  grep -E \
+    -e "^time=.*Finished processing block $range_end\b" \
+    -e "^time=.*finished processing statediff height $range_end\b" \
+    $LOG_FILE
+}
+
 run_service() {
   export LOG_FILE=$(mktemp)
   export LOG_FILE_PATH=$LOG_FILE
@@ -100,10 +112,7 @@ run_service() {
 
   echo "Waiting for service to complete requests..."
 
-  until grep \
-    -e "Finished processing block $range_end" \
-    -e "finished processing statediff height $range_end" \
-    $LOG_FILE
+  until range_finished
   do sleep 1; done
 
   kill -INT $!